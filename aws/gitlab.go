@@ -20,7 +20,7 @@ func (g GitlabStep) UnprocessedInputs(db *scanct.Database) ([]scanct.Finding, er
 }
 
 func (g GitlabStep) Process(finding *scanct.Finding) ([]scanct.AWSKey, error) {
-	client := http.Client{Timeout: 5 * time.Second}
+	client := http.Client{Timeout: 5 * time.Second, Transport: scanct.Transport}
 
 	resp, err := client.Get(finding.Repository.GitLab.BaseURL + "/" + finding.Repository.Name + "/-/raw/" + finding.Commit + "/" + finding.File)
 	if err != nil {
@@ -34,7 +34,7 @@ func (g GitlabStep) Process(finding *scanct.Finding) ([]scanct.AWSKey, error) {
 	if err != nil {
 		return nil, err
 	}
-	key, arn, err := ParseSecret(finding.Secret, string(body))
+	key, arn, err := parseSecret(finding.Secret, string(body))
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +42,7 @@ func (g GitlabStep) Process(finding *scanct.Finding) ([]scanct.AWSKey, error) {
 	return []scanct.AWSKey{{
 		AccessKey: finding.Secret,
 		SecretKey: key,
-		FindingID: finding.ID,
+		FindingID: &finding.ID,
 		Arn:       arn,
 	}}, nil
 }
@@ -20,7 +20,7 @@ func (g JenkinsStep) UnprocessedInputs(db *scanct.Database) ([]scanct.JenkinsFin
 }
 
 func (g JenkinsStep) Process(finding *scanct.JenkinsFinding) ([]scanct.AWSKey, error) {
-	client := http.Client{Timeout: 5 * time.Second}
+	client := http.Client{Timeout: 5 * time.Second, Transport: scanct.Transport}
 
 	finding.File = finding.File[strings.Index(finding.File, "/")+1:]
 	finding.File = finding.File[strings.Index(finding.File, "/")+1:]
@@ -39,15 +39,15 @@ func (g JenkinsStep) Process(finding *scanct.JenkinsFinding) ([]scanct.AWSKey, e
 	if err != nil {
 		return nil, err
 	}
-	key, arn, err := ParseSecret(finding.Secret, string(body))
+	key, arn, err := parseSecret(finding.Secret, string(body))
 	if err != nil {
 		return nil, err
 	}
 	return []scanct.AWSKey{{
-		AccessKey: finding.Secret,
-		SecretKey: key,
-		FindingID: finding.ID,
-		Arn:       arn,
+		AccessKey:        finding.Secret,
+		SecretKey:        key,
+		JenkinsFindingID: &finding.ID,
+		Arn:              arn,
 	}}, nil
 }
 
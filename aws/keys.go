@@ -13,6 +13,9 @@ import (
 	"time"
 )
 
+// parseSecret validates the candidate secrets of a finding. Tests replace it, so that they do not reach STS.
+var parseSecret = ParseSecret
+
 func ParseSecret(accessKeyId string, body string) (string, string, error) {
 	r, err := regexp.Compile("([a-zA-Z0-9/+]{40})")
 	if err != nil {
@@ -23,6 +26,7 @@ func ParseSecret(accessKeyId string, body string) (string, string, error) {
 		return "", "", errors.New("too many matches")
 	}
 	matches = scanct.Unique(matches)
+	// STS is not a scanned host, so it is not subject to the scope
 	client := http.Client{Timeout: 5 * time.Second}
 	for _, match := range matches {
 		if !strings.Contains(match, "EXAMPLE") {
@@ -0,0 +1,163 @@
+package aws
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"github.com/rgwohlbold/scanct"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// PostgresEnv is the DSN of a Postgres database to run the tests against instead of SQLite. Every test creates its
+// own schema in it.
+const PostgresEnv = "SCANCT_TEST_POSTGRES_DSN"
+
+// testDatabase configures an empty database for the steps. SQLite enforces foreign keys, like Postgres does.
+func testDatabase(t *testing.T) scanct.Database {
+	config := scanct.DatabaseConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "instances.db") + "?_foreign_keys=1"}
+	if dsn := os.Getenv(PostgresEnv); dsn != "" {
+		config = scanct.DatabaseConfig{Driver: "postgres", DSN: postgresSchema(t, dsn)}
+	}
+	scanct.SetDatabaseConfig(&config)
+	err := scanct.SetEncryptionKey(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = scanct.SetNetworkConfig(&scanct.NetworkConfig{AllowPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := scanct.NewDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// postgresSchema creates a schema that is dropped after the test and returns dsn with it as the search path.
+func postgresSchema(t *testing.T, dsn string) string {
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	suffix := make([]byte, 8)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := "scanct_test_" + hex.EncodeToString(suffix)
+	err = db.Exec("create schema " + schema).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Exec("drop schema " + schema + " cascade").Error
+		sqlDB, err := db.DB()
+		if err == nil {
+			_ = sqlDB.Close()
+		}
+	})
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		return dsn + separator + "search_path=" + schema
+	}
+	return dsn + " search_path=" + schema
+}
+
+func TestKeysSteps(t *testing.T) {
+	const gitLabKey = "AKIAGITLAB0000000000"
+	const jenkinsKey = "AKIAJENKINS000000000"
+	const secret = "wJalrXUtnFEMIK7MDENGbPxRfiCYzEXAMPLEKEYs"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("aws_secret_access_key = " + secret + "\n"))
+	}))
+	defer server.Close()
+	parseSecret = func(accessKeyId string, body string) (string, string, error) {
+		if !strings.Contains(body, secret) {
+			return "", "", errors.New("no tokens found")
+		}
+		return secret, "arn:aws:iam::123456789012:user/" + accessKeyId, nil
+	}
+	defer func() { parseSecret = ParseSecret }()
+
+	db := testDatabase(t)
+	ctLog, err := db.GetOrCreateCTLog(&scanct.CTLogConfig{URL: "https://ct.example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := db.StoreBatch(&scanct.CTBatch{Log: &ctLog, Start: 0, End: 0, Certificates: []scanct.Certificate{
+		{CTLogID: ctLog.ID, Subjects: []string{"gitlab.example.com", "jenkins.example.com"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostIDs := make(map[string]int)
+	for _, host := range hosts {
+		hostIDs[host.Name] = host.ID
+	}
+
+	gitLabs := []scanct.GitLab{{HostID: hostIDs["gitlab.example.com"], BaseURL: server.URL}}
+	err = db.AddGitLab(gitLabs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.InsertRepositories([]scanct.Repository{{GitLabID: gitLabs[0].ID, Name: "group/app"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repositories, err := db.GetUnprocessedRepositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.LogFindings([]scanct.Finding{
+		{RepositoryID: repositories[0].ID, Secret: gitLabKey, Commit: "abc123", File: "deploy.sh", StartLine: 1, EndLine: 1, Rule: "aws-access-token"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jenkins := []scanct.Jenkins{{HostID: hostIDs["jenkins.example.com"], BaseURL: server.URL}}
+	err = db.AddJenkins(jenkins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := []scanct.JenkinsJob{{JenkinsID: jenkins[0].ID, Name: "deploy", URL: server.URL + "/job/deploy"}}
+	err = db.AddJenkinsJob(jobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SaveJenkinsFindings([]scanct.JenkinsFinding{
+		{JobID: jobs[0].ID, Secret: jenkinsKey, File: "/tmp/" + scanct.Hash("deploy") + "/deploy/deploy.sh", StartLine: 1, EndLine: 1, Rule: "aws-access-token"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	RunGitlabKeysStep()
+	RunJenkinsKeysStep()
+
+	rows, err := db.QueryFindings(&scanct.ResultFilter{Validated: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	arns := make(map[string]string)
+	for _, row := range rows {
+		arns[row.Secret] = row.Arn
+	}
+	for _, key := range []string{gitLabKey, jenkinsKey} {
+		if want := "arn:aws:iam::123456789012:user/" + key; arns[key] != want {
+			t.Errorf("arn of %s = %q, want %q", key, arns[key], want)
+		}
+	}
+}
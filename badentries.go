@@ -0,0 +1,215 @@
+package scanct
+
+import (
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/tls"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// NewBadEntry quarantines leafEntry, which could not be parsed because of parseErr.
+func NewBadEntry(logID int, index int64, leafEntry *ct.LeafEntry, parseErr error) CTBadEntry {
+	return CTBadEntry{
+		CTLogID:   logID,
+		Index:     index,
+		LeafInput: leafEntry.LeafInput,
+		ExtraData: leafEntry.ExtraData,
+		Error:     parseErr.Error(),
+	}
+}
+
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+var oidCommonName = asn1.ObjectIdentifier{2, 5, 4, 3}
+
+// parseTBSLenient extracts the subject names and some metadata from a DER encoded TBSCertificate by walking its
+// fields, without validating anything that is not needed for that.
+func parseTBSLenient(tbs []byte) (Certificate, error) {
+	var fields []asn1.RawValue
+	_, err := asn1.Unmarshal(tbs, &fields)
+	if err != nil {
+		return Certificate{}, errors.Wrap(err, "could not split tbs certificate")
+	}
+	// the version is the only optional field before the subject public key
+	if len(fields) > 0 && fields[0].Class == asn1.ClassContextSpecific && fields[0].Tag == 0 {
+		fields = fields[1:]
+	}
+	if len(fields) < 6 {
+		return Certificate{}, errors.Errorf("tbs certificate has %d fields", len(fields))
+	}
+	var cert Certificate
+	if fields[0].Tag == asn1.TagInteger {
+		cert.Serial = new(big.Int).SetBytes(fields[0].Bytes).Text(16)
+	}
+	var issuer pkix.RDNSequence
+	if _, err = asn1.Unmarshal(fields[2].FullBytes, &issuer); err == nil {
+		var name pkix.Name
+		name.FillFromRDNSequence(&issuer)
+		cert.Issuer = name.String()
+	}
+	var validity struct {
+		NotBefore, NotAfter time.Time
+	}
+	if _, err = asn1.Unmarshal(fields[3].FullBytes, &validity); err == nil {
+		cert.NotBefore = validity.NotBefore.UTC()
+		cert.NotAfter = validity.NotAfter.UTC()
+	}
+	var subject pkix.RDNSequence
+	if _, err = asn1.Unmarshal(fields[4].FullBytes, &subject); err == nil {
+		for _, rdn := range subject {
+			for _, attribute := range rdn {
+				if value, ok := attribute.Value.(string); ok && attribute.Type.Equal(oidCommonName) {
+					cert.Subjects = append(cert.Subjects, value)
+				}
+			}
+		}
+	}
+	cert.PublicKeyFingerprint = fmt.Sprintf("%x", sha256.Sum256(fields[5].FullBytes))
+	for _, field := range fields[6:] {
+		if field.Class != asn1.ClassContextSpecific || field.Tag != 3 {
+			continue
+		}
+		var extensions []asn1.RawValue
+		_, err = asn1.Unmarshal(field.Bytes, &extensions)
+		if err != nil {
+			return Certificate{}, errors.Wrap(err, "could not split extensions")
+		}
+		for _, extension := range extensions {
+			var extensionFields []asn1.RawValue
+			_, err = asn1.Unmarshal(extension.FullBytes, &extensionFields)
+			if err != nil || len(extensionFields) < 2 {
+				continue
+			}
+			var oid asn1.ObjectIdentifier
+			_, err = asn1.Unmarshal(extensionFields[0].FullBytes, &oid)
+			if err != nil || !oid.Equal(oidSubjectAltName) {
+				continue
+			}
+			var names []asn1.RawValue
+			_, err = asn1.Unmarshal(extensionFields[len(extensionFields)-1].Bytes, &names)
+			if err != nil {
+				continue
+			}
+			for _, name := range names {
+				// dNSName is [2] IA5String
+				if name.Class == asn1.ClassContextSpecific && name.Tag == 2 {
+					cert.Subjects = append(cert.Subjects, string(name.Bytes))
+				}
+			}
+		}
+	}
+	cert.Subjects = Unique(cert.Subjects)
+	return cert, nil
+}
+
+// ParseLeafEntryLenient is ParseLeafEntry for entries that it rejects. It accepts certificates with fatal parse
+// errors as long as the subject names can be found.
+func ParseLeafEntryLenient(logID int, index int64, leafEntry *ct.LeafEntry) (Certificate, error) {
+	cert, err := ParseLeafEntry(logID, index, leafEntry)
+	if err == nil {
+		return cert, nil
+	}
+	var leaf ct.MerkleTreeLeaf
+	_, err = tls.Unmarshal(leafEntry.LeafInput, &leaf)
+	if err != nil {
+		return Certificate{}, errors.Wrap(err, "could not parse leaf")
+	}
+	if leaf.LeafType != ct.TimestampedEntryLeafType {
+		return Certificate{}, errors.Errorf("unknown leaf type %d", leaf.LeafType)
+	}
+	entry := leaf.TimestampedEntry
+	var tbs []byte
+	precert := false
+	switch entry.EntryType {
+	case ct.X509LogEntryType:
+		x509Cert, _ := x509.ParseCertificate(entry.X509Entry.Data)
+		if x509Cert != nil {
+			cert = NewCertificate(x509Cert, false)
+			break
+		}
+		var certFields []asn1.RawValue
+		_, err = asn1.Unmarshal(entry.X509Entry.Data, &certFields)
+		if err != nil || len(certFields) == 0 {
+			return Certificate{}, errors.New("could not split certificate")
+		}
+		tbs = certFields[0].FullBytes
+	case ct.PrecertLogEntryType:
+		precert = true
+		tbs = entry.PrecertEntry.TBSCertificate
+	default:
+		return Certificate{}, errors.Errorf("unknown entry type %d", entry.EntryType)
+	}
+	if tbs != nil {
+		cert, err = parseTBSLenient(tbs)
+		if err != nil {
+			return Certificate{}, err
+		}
+		cert.Precert = precert
+	}
+	if len(cert.Subjects) == 0 {
+		return Certificate{}, errors.New("no subject names found")
+	}
+	cert.CTLogID = logID
+	cert.Index = index
+	cert.Timestamp = time.UnixMilli(int64(entry.Timestamp)).UTC()
+	return cert, nil
+}
+
+// ListBadEntries logs all quarantined entries.
+func ListBadEntries() {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	badEntries, err := db.GetBadEntries()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not get bad entries")
+	}
+	for _, badEntry := range badEntries {
+		log.Info().Str("log", badEntry.CTLog.URL).Int64("index", badEntry.Index).Int("retries", badEntry.Retries).Str("error", badEntry.Error).Msg("bad entry")
+	}
+	log.Info().Int("count", len(badEntries)).Msg("listed bad entries")
+}
+
+// RetryBadEntries parses all quarantined entries again with ParseLeafEntryLenient and stores those that succeed.
+func RetryBadEntries(config *CTConfig) {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	err = db.SetIngestRules(&config.Ingest)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid ingest rules")
+	}
+	badEntries, err := db.GetBadEntries()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not get bad entries")
+	}
+	resolved := 0
+	for i := range badEntries {
+		badEntry := &badEntries[i]
+		leafEntry := ct.LeafEntry{LeafInput: badEntry.LeafInput, ExtraData: badEntry.ExtraData}
+		cert, parseErr := ParseLeafEntryLenient(badEntry.CTLogID, badEntry.Index, &leafEntry)
+		if parseErr != nil {
+			log.Warn().Err(parseErr).Str("log", badEntry.CTLog.URL).Int64("index", badEntry.Index).Msg("could not parse bad entry")
+			err = db.SetBadEntryError(badEntry, parseErr)
+		} else {
+			log.Info().Str("log", badEntry.CTLog.URL).Int64("index", badEntry.Index).Str("subjects", strings.Join(cert.Subjects, ",")).Msg("parsed bad entry")
+			err = db.ResolveBadEntry(badEntry, cert)
+			resolved++
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not update bad entry")
+		}
+	}
+	log.Info().Int("resolved", resolved).Int("remaining", len(badEntries)-resolved).Msg("retried bad entries")
+}
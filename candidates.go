@@ -0,0 +1,136 @@
+package scanct
+
+import (
+	"github.com/pkg/errors"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// CandidatePatterns select the hosts that a filter step probes. Prefixes match the start of a name, e.g. "gitlab."
+// matches gitlab.example.com. Labels match a whole label below the registrable domain, e.g. "ci" matches
+// build.ci.example.com but not ci.com. Regexes match anywhere in the name unless anchored. A host that matches any
+// pattern is a candidate unless it also matches one of the exclusions.
+type CandidatePatterns struct {
+	Prefixes        []string `json:"prefixes"`
+	Labels          []string `json:"labels"`
+	Regexes         []string `json:"regexes"`
+	ExcludePrefixes []string `json:"exclude_prefixes"`
+	ExcludeLabels   []string `json:"exclude_labels"`
+	ExcludeRegexes  []string `json:"exclude_regexes"`
+}
+
+// Candidate is a host selected for a filter step. Reason is the pattern that selected it, such as "prefix:gitlab.".
+type Candidate struct {
+	Host
+	Reason string
+}
+
+// CandidateMatcher evaluates compiled CandidatePatterns.
+type CandidateMatcher struct {
+	prefixes        []string
+	labels          []string
+	regexes         []*regexp.Regexp
+	excludePrefixes []string
+	excludeLabels   []string
+	excludeRegexes  []*regexp.Regexp
+}
+
+func lowerAll(values []string) []string {
+	lower := make([]string, 0, len(values))
+	for _, value := range values {
+		lower = append(lower, strings.ToLower(strings.TrimSpace(value)))
+	}
+	return lower
+}
+
+func NewCandidateMatcher(patterns *CandidatePatterns) (*CandidateMatcher, error) {
+	regexes, err := compileRegexes(patterns.Regexes)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not compile candidate regexes")
+	}
+	excludeRegexes, err := compileRegexes(patterns.ExcludeRegexes)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not compile exclude regexes")
+	}
+	return &CandidateMatcher{
+		prefixes:        lowerAll(patterns.Prefixes),
+		labels:          lowerAll(patterns.Labels),
+		regexes:         regexes,
+		excludePrefixes: lowerAll(patterns.ExcludePrefixes),
+		excludeLabels:   lowerAll(patterns.ExcludeLabels),
+		excludeRegexes:  excludeRegexes,
+	}, nil
+}
+
+// subdomainLabels returns the labels of name below its registrable domain.
+func subdomainLabels(name string, domain string) []string {
+	if domain == "" || name == domain || !strings.HasSuffix(name, "."+domain) {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(name, "."+domain), ".")
+}
+
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+// Match returns the reason why host is a candidate, or false if it is not one. Whether the host was processed
+// already is not checked.
+func (m *CandidateMatcher) Match(host *Host) (string, bool) {
+	labels := subdomainLabels(host.Name, host.Domain)
+	for _, prefix := range m.excludePrefixes {
+		if strings.HasPrefix(host.Name, prefix) {
+			return "", false
+		}
+	}
+	for _, label := range m.excludeLabels {
+		if hasLabel(labels, label) {
+			return "", false
+		}
+	}
+	for _, regex := range m.excludeRegexes {
+		if regex.MatchString(host.Name) {
+			return "", false
+		}
+	}
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(host.Name, prefix) {
+			return "prefix:" + prefix, true
+		}
+	}
+	for _, label := range m.labels {
+		if hasLabel(labels, label) {
+			return "label:" + label, true
+		}
+	}
+	for _, regex := range m.regexes {
+		if regex.MatchString(host.Name) {
+			return "regex:" + regex.String(), true
+		}
+	}
+	return "", false
+}
+
+// regexPrefix returns the literal that every name matched by regex starts with. It is empty unless the regex is
+// anchored at the start.
+func regexPrefix(regex *regexp.Regexp) string {
+	re, err := syntax.Parse(regex.String(), syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 || re.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+	literal := re.Sub[1]
+	if literal.Op != syntax.OpLiteral || literal.Flags&syntax.FoldCase != 0 {
+		return ""
+	}
+	return string(literal.Rune)
+}
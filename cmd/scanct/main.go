@@ -1,22 +1,32 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"github.com/pkg/errors"
 	"github.com/rgwohlbold/scanct"
 	"github.com/rgwohlbold/scanct/aws"
+	"github.com/rgwohlbold/scanct/dns"
 	"github.com/rgwohlbold/scanct/gitlab"
 	"github.com/rgwohlbold/scanct/jenkins"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"math"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 )
 
-func FullProcess() {
-	gitlab.FilterInstances()
-	jenkins.FilterInstances()
+func FullProcess(dnsConfig *scanct.DNSConfig, gitlabMatcher, jenkinsMatcher *scanct.CandidateMatcher) {
+	dns.ResolveHosts(dnsConfig, gitlabMatcher, jenkinsMatcher)
+	gitlab.FilterInstances(gitlabMatcher)
+	jenkins.FilterInstances(jenkinsMatcher)
+	ScanProcess()
+}
+
+// ScanProcess runs all steps after filtering instances.
+func ScanProcess() {
 	gitlab.ImportRepositories()
 	jenkins.ImportJobs()
 	gitlab.ScanSecrets()
@@ -25,40 +35,328 @@ func FullProcess() {
 	aws.RunJenkinsKeysStep()
 }
 
+// Follow tails the CT logs and probes new instances right after they are stored. Candidates that were not resolved
+// yet are resolved first, so that only live hosts are probed. The later steps keep running in the background.
+func Follow(ctConfig *scanct.CTConfig, dnsConfig *scanct.DNSConfig, gitlabMatcher, jenkinsMatcher *scanct.CandidateMatcher) {
+	gitlabChan := make(chan scanct.Candidate, 1000)
+	jenkinsChan := make(chan scanct.Candidate, 1000)
+	dnsChan := make(chan scanct.Candidate, 1000)
+	go gitlab.FilterStream(gitlabChan)
+	go jenkins.FilterStream(jenkinsChan)
+	probe := func(host *scanct.Host) {
+		if candidate, ok := gitlab.IsCandidate(gitlabMatcher, host); ok {
+			gitlabChan <- candidate
+		}
+		if candidate, ok := jenkins.IsCandidate(jenkinsMatcher, host); ok {
+			jenkinsChan <- candidate
+		}
+	}
+	resolved := make(chan struct{})
+	go func() {
+		dns.ResolveStream(dnsConfig, dnsChan, func(candidate scanct.Candidate) {
+			probe(&candidate.Host)
+		})
+		close(resolved)
+	}()
+	go func() {
+		for {
+			// Make each iteration take at least 5 minutes to avoid busy looping over an empty database
+			minTimeChannel := time.After(5 * time.Minute)
+			ScanProcess()
+			<-minTimeChannel
+		}
+	}()
+	scanct.TailCertificates(ctConfig, func(hosts []scanct.Host) {
+		for _, host := range hosts {
+			if host.DNSProcessed {
+				probe(&host)
+				continue
+			}
+			_, gitlabCandidate := gitlab.IsCandidate(gitlabMatcher, &host)
+			_, jenkinsCandidate := jenkins.IsCandidate(jenkinsMatcher, &host)
+			if gitlabCandidate || jenkinsCandidate {
+				dnsChan <- scanct.Candidate{Host: host}
+			}
+		}
+	})
+	close(dnsChan)
+	<-resolved
+	close(gitlabChan)
+	close(jenkinsChan)
+}
+
+func CTConfig(config *scanct.Config) scanct.CTConfig {
+	logs, err := scanct.LogsFromLogList(config.LogList)
+	if err != nil {
+		log.Fatal().Err(err).Str("path", config.LogList.Path).Msg("could not load logs")
+	}
+	for _, l := range logs {
+		log.Info().Str("log", l.URL).Str("operator", l.Operator).Msg("selected log")
+	}
+	ctConfig := config.CT
+	ctConfig.Logs = logs
+	return ctConfig
+}
+
+func CandidateMatcher(patterns *scanct.CandidatePatterns) *scanct.CandidateMatcher {
+	matcher, err := scanct.NewCandidateMatcher(patterns)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid candidate patterns")
+	}
+	return matcher
+}
+
+// ListFlags are the flags of the list commands.
+type ListFlags struct {
+	Filter      scanct.ResultFilter
+	Format      string
+	ShowSecrets bool
+}
+
+// parseTime parses an RFC 3339 time or a date. With endOfDay, a date means the end of that day.
+func parseTime(value string, endOfDay bool) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid time %q, use a date like 2006-01-02 or an RFC 3339 time", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// ParseListFlags parses the flags of the list command name. The flag to show secrets is only defined with secrets.
+func ParseListFlags(name string, args []string, secrets bool) ListFlags {
+	var l ListFlags
+	var since, until, processed string
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&l.Filter.Service, "service", "", "only list results of 'gitlab' or 'jenkins'")
+	flags.StringVar(&l.Filter.Rule, "rule", "", "only list findings of this rule, or instances selected by this candidate pattern")
+	flags.StringVar(&l.Filter.Host, "host", "", "only list results of this host and the names below it")
+	flags.StringVar(&since, "since", "", "only list results found at or after this date or time")
+	flags.StringVar(&until, "until", "", "only list results found on or before this date, or before this time")
+	flags.StringVar(&processed, "processed", "", "only list processed ('true') or unprocessed ('false') results")
+	flags.BoolVar(&l.Filter.Validated, "validated", false, "only list validated results")
+	flags.StringVar(&l.Format, "format", scanct.FormatTable, "output format: 'table', 'json' or 'csv'")
+	if secrets {
+		flags.BoolVar(&l.ShowSecrets, "show-secrets", false, "print secrets instead of redacting them")
+	}
+	_ = flags.Parse(args)
+
+	var err error
+	if l.Filter.Service != "" && l.Filter.Service != scanct.ServiceGitLab && l.Filter.Service != scanct.ServiceJenkins {
+		log.Fatal().Str("service", l.Filter.Service).Msg("unknown service. choose either 'gitlab' or 'jenkins'.")
+	}
+	if since != "" {
+		l.Filter.Since, err = parseTime(since, false)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not parse -since")
+		}
+	}
+	if until != "" {
+		l.Filter.Until, err = parseTime(until, true)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not parse -until")
+		}
+	}
+	if processed != "" {
+		p, err := strconv.ParseBool(processed)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not parse -processed")
+		}
+		l.Filter.Processed = &p
+	}
+	if l.Format != scanct.FormatTable && l.Format != scanct.FormatJSON && l.Format != scanct.FormatCSV {
+		log.Fatal().Str("format", l.Format).Msg("unknown format. choose either 'table', 'json' or 'csv'.")
+	}
+	return l
+}
+
+// RecordRun stores run, so that the results of a scan can be traced back to its command and scope. Only commands
+// that scan are recorded, after their arguments were parsed.
+func RecordRun(run *scanct.Run) {
+	db, err := scanct.NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	err = db.AddRun(run)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not record run")
+	}
+}
+
+// NeedsKey reports whether the command in args stores or reads credentials, which needs the encryption key.
+func NeedsKey(args []string) bool {
+	if len(args) < 1 {
+		return false
+	}
+	action := ""
+	if len(args) >= 2 {
+		action = args[1]
+	}
+	switch args[0] {
+	case "gitlab", "findings", "export", "full":
+		return true
+	case "jenkins":
+		return action == "secrets" || action == "aws"
+	case "db":
+		return action == "rekey"
+	}
+	return false
+}
+
 func main() {
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	db, err := scanct.NewDatabase()
+	if len(os.Args) < 2 {
+		log.Fatal().Msg("no subcommand given. choose either 'ct', 'dns', 'jenkins', 'gitlab', 'findings', 'instances', 'export', 'db'.")
+	}
+
+	config, err := scanct.LoadConfig(scanct.ConfigFile)
 	if err != nil {
-		log.Fatal().Err(err).Msg("could not open database")
+		log.Fatal().Err(err).Msg("could not load config")
+	}
+	scanct.SetDatabaseConfig(&config.Database)
+	key, err := scanct.LoadKey(config.Database.KeyFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not load encryption key")
+	}
+	if key != nil {
+		err = scanct.SetEncryptionKey(key)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid encryption key")
+		}
+	} else if NeedsKey(os.Args[1:]) {
+		log.Fatal().Msgf("no encryption key. this command stores or reads credentials, set %s or database.key_file.", scanct.KeyEnv)
+	}
+	err = scanct.SetNetworkConfig(&config.Network)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid network config")
 	}
-	db.Close()
 
-	if len(os.Args) < 2 {
-		log.Fatal().Msg("no subcommand given. choose either 'ct', 'jenkins', 'gitlab'.")
+	run := scanct.Run{StartedAt: time.Now().UTC(), Command: strings.Join(os.Args[1:], " ")}
+	if config.ScopeFile != "" {
+		scope, err := scanct.LoadScope(config.ScopeFile)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", config.ScopeFile).Msg("could not load scope")
+		}
+		scanct.SetScope(scope)
+		data, err := json.Marshal(scope)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not marshal scope")
+		}
+		run.ScopeFile = config.ScopeFile
+		run.Scope = string(data)
+		log.Info().Strs("domains", scope.Domains).Strs("exclude", scope.Exclude).Strs("cidrs", scope.CIDRs).Msg("restricting to scope")
 	}
+
+	// migrations run before the database is opened, which fails while they are pending
+	if len(os.Args) >= 2 && os.Args[1] == "db" {
+		if len(os.Args) < 3 {
+			log.Fatal().Msg("no action given. choose either 'migrate', 'status' or 'rekey'.")
+		}
+		if os.Args[2] == "migrate" {
+			scanct.MigrateDatabase()
+		} else if os.Args[2] == "status" {
+			scanct.ListMigrations()
+		} else if os.Args[2] == "rekey" {
+			if len(os.Args) < 4 {
+				log.Fatal().Msg("no key file given.")
+			}
+			newKey, err := scanct.ReadKeyFile(os.Args[3])
+			if err != nil {
+				log.Fatal().Err(err).Str("path", os.Args[3]).Msg("could not load new key")
+			}
+			scanct.Rekey(newKey)
+		} else {
+			log.Fatal().Msg("unknown action. choose either 'migrate', 'status' or 'rekey'.")
+		}
+		return
+	}
+
 	if os.Args[1] == "ct" {
-		config := scanct.CTConfig{URL: "https://oak.ct.letsencrypt.org/2023/", GetEntriesBatchSize: 256, GetEntriesRetries: 5, NumCerts: math.MaxInt64}
+		if len(os.Args) >= 3 && os.Args[2] == "import" {
+			if len(os.Args) < 4 {
+				log.Fatal().Msg("no dump file given.")
+			}
+			RecordRun(&run)
+			scanct.ImportDump(&config.CT, os.Args[3])
+			return
+		}
+		if len(os.Args) >= 3 && os.Args[2] == "bad-entries" {
+			if len(os.Args) < 4 || os.Args[3] == "list" {
+				scanct.ListBadEntries()
+			} else if os.Args[3] == "retry" {
+				RecordRun(&run)
+				scanct.RetryBadEntries(&config.CT)
+			} else {
+				log.Fatal().Msg("unknown action. choose either 'list' or 'retry'.")
+			}
+			return
+		}
+		if len(os.Args) >= 3 && os.Args[2] == "verification-errors" {
+			if len(os.Args) < 4 || os.Args[3] == "list" {
+				scanct.ListVerificationErrors()
+			} else if os.Args[3] == "clear" {
+				if len(os.Args) < 5 {
+					log.Fatal().Msg("no log url given.")
+				}
+				scanct.ClearVerificationError(os.Args[4])
+			} else {
+				log.Fatal().Msg("unknown action. choose either 'list' or 'clear'.")
+			}
+			return
+		}
+		if len(os.Args) >= 3 && os.Args[2] == "dropped" {
+			scanct.ListDroppedNames()
+			return
+		}
+		if len(os.Args) >= 3 && os.Args[2] == "stream" {
+			if len(os.Args) < 4 {
+				log.Fatal().Msg("no certstream url given.")
+			}
+			RecordRun(&run)
+			scanct.StreamCertificates(&config.CT, os.Args[3])
+			return
+		}
+		ctConfig := CTConfig(&config)
+		if len(os.Args) >= 3 && os.Args[2] == "gaps" {
+			RecordRun(&run)
+			scanct.ListGaps(&ctConfig)
+			scanct.FillGaps(&ctConfig)
+			return
+		}
 		if len(os.Args) >= 3 {
-			config.NumCerts, err = strconv.ParseInt(os.Args[2], 10, 64)
+			ctConfig.NumCerts, err = strconv.ParseInt(os.Args[2], 10, 64)
 			if err != nil {
 				log.Fatal().Err(err).Msg("could not parse number of certs")
 			}
 		}
-		scanct.ImportCertificates(&config)
+		RecordRun(&run)
+		scanct.ImportCertificates(&ctConfig)
 	} else if os.Args[1] == "jenkins" {
 		if len(os.Args) < 3 {
 			log.Fatal().Msg("no action given. choose either 'filter', 'jobs' or 'secrets'.")
 		}
 		if os.Args[2] == "filter" {
-			jenkins.FilterInstances()
+			matcher := CandidateMatcher(&config.Candidates.Jenkins)
+			RecordRun(&run)
+			jenkins.FilterInstances(matcher)
 		} else if os.Args[2] == "jobs" {
+			RecordRun(&run)
 			jenkins.ImportJobs()
 		} else if os.Args[2] == "secrets" {
+			RecordRun(&run)
 			jenkins.ScanSecrets()
 		} else if os.Args[2] == "aws" {
+			RecordRun(&run)
 			aws.RunJenkinsKeysStep()
 		} else {
 			log.Fatal().Msg("unknown action. choose either 'filter', 'jobs' or 'secrets'.")
@@ -68,41 +366,67 @@ func main() {
 			log.Fatal().Msg("no action given. choose either 'filter', 'repositories' or 'secrets'.")
 		}
 		if os.Args[2] == "filter" {
-			gitlab.FilterInstances()
+			matcher := CandidateMatcher(&config.Candidates.GitLab)
+			RecordRun(&run)
+			gitlab.FilterInstances(matcher)
 		} else if os.Args[2] == "repositories" {
+			RecordRun(&run)
 			gitlab.ImportRepositories()
 		} else if os.Args[2] == "secrets" {
+			RecordRun(&run)
 			gitlab.ScanSecrets()
 		} else if os.Args[2] == "aws" {
+			RecordRun(&run)
 			aws.RunGitlabKeysStep()
 		} else {
 			log.Fatal().Msg("unknown action. choose either 'filter', 'repositories' or 'secrets'.")
 		}
+	} else if os.Args[1] == "findings" {
+		if len(os.Args) < 3 || os.Args[2] != "list" {
+			log.Fatal().Msg("unknown action. choose 'list'.")
+		}
+		l := ParseListFlags("findings list", os.Args[3:], true)
+		scanct.ListFindings(&l.Filter, l.Format, l.ShowSecrets)
+	} else if os.Args[1] == "instances" {
+		if len(os.Args) < 3 || os.Args[2] != "list" {
+			log.Fatal().Msg("unknown action. choose 'list'.")
+		}
+		l := ParseListFlags("instances list", os.Args[3:], false)
+		scanct.ListInstances(&l.Filter, l.Format)
+	} else if os.Args[1] == "export" {
+		if len(os.Args) < 3 || os.Args[2] != "sarif" {
+			log.Fatal().Msg("unknown format. choose 'sarif'.")
+		}
+		var output string
+		var showSecrets bool
+		flags := flag.NewFlagSet("export sarif", flag.ExitOnError)
+		flags.StringVar(&output, "output", "", "write to this file instead of stdout")
+		flags.BoolVar(&showSecrets, "show-secrets", false, "include secrets instead of redacting them")
+		_ = flags.Parse(os.Args[3:])
+		scanct.ExportSARIF(output, showSecrets)
+	} else if os.Args[1] == "dns" {
+		gitlabMatcher := CandidateMatcher(&config.Candidates.GitLab)
+		jenkinsMatcher := CandidateMatcher(&config.Candidates.Jenkins)
+		RecordRun(&run)
+		dns.ResolveHosts(&config.DNS, gitlabMatcher, jenkinsMatcher)
 	} else if os.Args[1] == "full" {
-		config := scanct.CTConfig{URL: "https://oak.ct.letsencrypt.org/2023/", GetEntriesBatchSize: 256, GetEntriesRetries: 5, NumCerts: math.MaxInt64}
+		ctConfig := CTConfig(&config)
+		gitlabMatcher := CandidateMatcher(&config.Candidates.GitLab)
+		jenkinsMatcher := CandidateMatcher(&config.Candidates.Jenkins)
 		if len(os.Args) >= 3 {
-			config.NumCerts, err = strconv.ParseInt(os.Args[2], 10, 64)
+			ctConfig.NumCerts, err = strconv.ParseInt(os.Args[2], 10, 64)
 			if err != nil {
 				log.Fatal().Err(err).Msg("could not parse number of certs")
 			}
-			scanct.ImportCertificates(&config)
-			FullProcess()
+			RecordRun(&run)
+			scanct.ImportCertificates(&ctConfig)
+			FullProcess(&config.DNS, gitlabMatcher, jenkinsMatcher)
 		} else {
-			FullProcess()
-			config.NumCerts = 10000000
-			for {
-				// Make each iteration take at least 5 minutes to avoid spamming the CT logs
-				minTimeChannel := time.After(5 * time.Minute)
-				log.Info().Msg("starting daemon iteration")
-
-				scanct.ImportCertificates(&config)
-				FullProcess()
-
-				log.Info().Msg("waiting for next daemon iteration")
-				<-minTimeChannel
-			}
+			RecordRun(&run)
+			FullProcess(&config.DNS, gitlabMatcher, jenkinsMatcher)
+			Follow(&ctConfig, &config.DNS, gitlabMatcher, jenkinsMatcher)
 		}
 	} else {
-		log.Fatal().Msg("unknown subcommand. choose either 'ct', 'jenkins', 'gitlab'.")
+		log.Fatal().Msg("unknown subcommand. choose either 'ct', 'dns', 'jenkins', 'gitlab', 'findings', 'instances', 'export', 'db'.")
 	}
 }
@@ -0,0 +1,106 @@
+package scanct
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"math"
+	"os"
+	"time"
+)
+
+// Duration is a time.Duration that is written as a string such as "10s" in the config.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return errors.Wrap(err, "duration must be a string")
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Config holds the settings read from ConfigFile. Fields missing from the file keep their defaults.
+type Config struct {
+	Database   DatabaseConfig   `json:"database"`
+	LogList    LogListConfig    `json:"log_list"`
+	CT         CTConfig         `json:"ct"`
+	Candidates CandidatesConfig `json:"candidates"`
+	DNS        DNSConfig        `json:"dns"`
+	Network    NetworkConfig    `json:"network"`
+	// ScopeFile restricts scanning to the domains and addresses in a scope file, see Scope.
+	ScopeFile string `json:"scope_file"`
+}
+
+// CandidatesConfig holds the patterns of the hosts that each filter step probes.
+type CandidatesConfig struct {
+	GitLab  CandidatePatterns `json:"gitlab"`
+	Jenkins CandidatePatterns `json:"jenkins"`
+}
+
+// DNSConfig configures the resolution of candidate hosts. Server is the address of the resolver, the first
+// nameserver of /etc/resolv.conf if empty. Queries that time out are sent again up to Retries times.
+type DNSConfig struct {
+	Server  string   `json:"server"`
+	Timeout Duration `json:"timeout"`
+	Retries int      `json:"retries"`
+	Workers int      `json:"workers"`
+}
+
+const ConfigFile = "./scanct.json"
+
+func DefaultConfig() Config {
+	return Config{
+		Database: DatabaseConfig{
+			Driver:        "sqlite",
+			DSN:           DefaultDSN,
+			FlushSize:     500,
+			FlushInterval: Duration(time.Second),
+		},
+		LogList: LogListConfig{
+			Path:   "./log_list.json",
+			States: []string{"usable"},
+		},
+		CT: CTConfig{
+			GetEntriesRetries:   5,
+			GetEntriesBatchSize: 256,
+			NumCerts:            math.MaxInt64,
+			TailInterval:        Duration(10 * time.Second),
+			RequestsPerSecond:   10,
+		},
+		Candidates: CandidatesConfig{
+			GitLab: CandidatePatterns{
+				Prefixes:        []string{"gitlab."},
+				ExcludePrefixes: []string{"gitlab.git"},
+			},
+			Jenkins: CandidatePatterns{
+				Prefixes: []string{"jenkins."},
+			},
+		},
+		DNS: DNSConfig{
+			Timeout: Duration(5 * time.Second),
+			Retries: 2,
+			Workers: 50,
+		},
+	}
+}
+
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	} else if err != nil {
+		return Config{}, errors.Wrap(err, "could not read config")
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return Config{}, errors.Wrap(err, "could not parse config")
+	}
+	return config, nil
+}
@@ -2,25 +2,72 @@ package scanct
 
 import (
 	"context"
+	"crypto/sha256"
+	"fmt"
 	ct "github.com/google/certificate-transparency-go"
 	"github.com/google/certificate-transparency-go/client"
 	"github.com/google/certificate-transparency-go/jsonclient"
+	"github.com/google/certificate-transparency-go/tls"
+	"github.com/google/certificate-transparency-go/x509"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
 type CTConfig struct {
-	URL                 string
-	GetEntriesRetries   int
-	GetEntriesBatchSize int64
-	NumCerts            int64
+	Logs                []CTLogConfig `json:"-"`
+	GetEntriesRetries   int           `json:"get_entries_retries"`
+	GetEntriesBatchSize int64         `json:"get_entries_batch_size"`
+	NumCerts            int64         `json:"-"`
+	// VerifyInclusion requests an inclusion proof for every fetched entry.
+	VerifyInclusion bool `json:"verify_inclusion"`
+	// TailInterval is the time between two STH polls when following logs.
+	TailInterval Duration `json:"tail_interval"`
+	// RequestsPerSecond limits the requests to each log, shared by all workers. Zero or less means no limit.
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	// TileCacheDir stores the full tiles and issuers fetched from static CT API logs. Caching is disabled if empty.
+	TileCacheDir string `json:"tile_cache_dir"`
+	// Ingest selects the hostnames that are stored, see IngestRules.
+	Ingest IngestRules `json:"ingest"`
 }
 
-type Certificate struct {
-	Subjects []string
-	Index    int64
+// CTLogConfig describes a log from the log list. MonitoringURL is only set for logs that implement the static
+// CT API, whose URL is the submission prefix.
+type CTLogConfig struct {
+	URL           string
+	MonitoringURL string
+	Description   string
+	Operator      string
+	PublicKey     []byte
+	MMD           time.Duration
+}
+
+// CTRequest asks a process worker to fetch the entries from Start to End, inclusive, from Log. Ctx is cancelled
+// once ingestion from the log is stopped.
+type CTRequest struct {
+	Ctx   context.Context
+	Log   *CTLog
+	Start int64
+	End   int64
+}
+
+// CTBatch holds one certificate or bad entry for every entry from Start to End. If Err is set, the entries after
+// End up to the end of the request could not be fetched. If VerifyErr is set, the log could not prove that the
+// entries are part of its tree and ingestion from it has to stop. BatchSize is set when the log truncated a
+// response to more entries than the batch size known before.
+type CTBatch struct {
+	Log          *CTLog
+	Start        int64
+	End          int64
+	Certificates []Certificate
+	BadEntries   []CTBadEntry
+	BatchSize    int64
+	Err          error
+	VerifyErr    error
 }
 
 func Unique[T comparable](slice []T) []T {
@@ -36,171 +83,645 @@ func Unique[T comparable](slice []T) []T {
 	return uniqSlice
 }
 
-func ConnectLog(config *CTConfig) (*client.LogClient, error) {
+// LogClient reads entries, tree heads and proofs from a log. It is implemented for RFC 6962 logs and for static
+// CT API logs by TileClient.
+type LogClient interface {
+	GetSTH(ctx context.Context) (*ct.SignedTreeHead, error)
+	GetRawEntries(ctx context.Context, start, end int64) (*ct.GetEntriesResponse, error)
+	GetSTHConsistency(ctx context.Context, first, second uint64) ([][]byte, error)
+	GetInclusionProof(ctx context.Context, index int64, leafHash []byte, treeSize uint64) ([][]byte, error)
+}
+
+// ErrInvalidSTH is returned for tree heads that a log served successfully but that cannot be converted or are not
+// signed by the log. Failures to fetch or decode the response are not wrapped in it, they may go away on retry.
+var ErrInvalidSTH = errors.New("invalid sth")
+
+type rfc6962Client struct {
+	*client.LogClient
+}
+
+// GetSTH replaces client.LogClient.GetSTH, which reports transport, decoding and signature errors all as
+// client.RspError and so does not allow to tell a misbehaving log from a failed request.
+func (c rfc6962Client) GetSTH(ctx context.Context) (*ct.SignedTreeHead, error) {
+	var resp ct.GetSTHResponse
+	_, _, err := c.GetAndParse(ctx, ct.GetSTHPath, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	sth, err := resp.ToSignedTreeHead()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSTH, err)
+	}
+	err = c.VerifySTHSignature(*sth)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSTH, err)
+	}
+	return sth, nil
+}
+
+func (c rfc6962Client) GetInclusionProof(ctx context.Context, index int64, leafHash []byte, treeSize uint64) ([][]byte, error) {
+	resp, err := c.GetProofByHash(ctx, leafHash, treeSize)
+	if err != nil {
+		return nil, err
+	}
+	if resp.LeafIndex != index {
+		return nil, fmt.Errorf("leaf hash belongs to index %d", resp.LeafIndex)
+	}
+	return resp.AuditPath, nil
+}
+
+// ConnectLog creates a client for ctLog. If limiter is not nil, all requests of the client go through it.
+func ConnectLog(config *CTConfig, ctLog *CTLog, limiter *LogLimiter) (LogClient, error) {
 	httpClient := &http.Client{
 		Timeout: 10 * time.Second,
-		Transport: &http.Transport{
-			TLSHandshakeTimeout:   30 * time.Second,
-			ResponseHeaderTimeout: 30 * time.Second,
-			MaxIdleConnsPerHost:   10,
-			DisableKeepAlives:     false,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       90 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
+		Transport: &rateLimitTransport{
+			base: &http.Transport{
+				TLSHandshakeTimeout:   30 * time.Second,
+				ResponseHeaderTimeout: 30 * time.Second,
+				MaxIdleConnsPerHost:   10,
+				DisableKeepAlives:     false,
+				MaxIdleConns:          100,
+				IdleConnTimeout:       90 * time.Second,
+				ExpectContinueTimeout: 1 * time.Second,
+			},
+			limiter: limiter,
 		},
 	}
-	return client.New(config.URL, httpClient, jsonclient.Options{})
+	if ctLog.MonitoringURL != "" {
+		return NewTileClient(ctLog, httpClient, config.TileCacheDir)
+	}
+	// with a public key, the client verifies the signature of every STH it receives
+	c, err := client.New(ctLog.URL, httpClient, jsonclient.Options{PublicKeyDER: ctLog.PublicKey})
+	if err != nil {
+		return nil, err
+	}
+	return rfc6962Client{c}, nil
 }
 
-func CTProcessWorker(config *CTConfig, startChan <-chan int64, certChan chan<- []Certificate) {
-	ctx := context.Background()
-	c, err := ConnectLog(config)
-	if err != nil {
-		log.Fatal().Err(err)
+// ParseLeafEntry extracts the subject names and metadata of the certificate or precertificate in leafEntry.
+func ParseLeafEntry(logID int, index int64, leafEntry *ct.LeafEntry) (Certificate, error) {
+	entry, err := ct.LogEntryFromLeaf(index, leafEntry)
+	if x509.IsFatal(err) {
+		return Certificate{}, errors.Wrap(err, "could not parse entry")
+	}
+	if entry.Leaf.LeafType != ct.TimestampedEntryLeafType {
+		return Certificate{}, errors.New("not a timestamped entry")
+	}
+	var x509Cert *x509.Certificate
+	if entry.Leaf.TimestampedEntry.EntryType == ct.X509LogEntryType {
+		x509Cert, err = entry.Leaf.X509Certificate()
+		if x509.IsFatal(err) {
+			return Certificate{}, errors.Wrap(err, "could not parse certificate")
+		}
+	} else if entry.Leaf.TimestampedEntry.EntryType == ct.PrecertLogEntryType {
+		x509Cert, err = entry.Leaf.Precertificate()
+		if x509.IsFatal(err) {
+			return Certificate{}, errors.Wrap(err, "could not parse precertificate")
+		}
+	} else {
+		return Certificate{}, errors.Errorf("unknown entry type %d", entry.Leaf.TimestampedEntry.EntryType)
+	}
+	cert := NewCertificate(x509Cert, entry.Leaf.TimestampedEntry.EntryType == ct.PrecertLogEntryType)
+	cert.CTLogID = logID
+	cert.Index = index
+	cert.Timestamp = time.UnixMilli(int64(entry.Leaf.TimestampedEntry.Timestamp)).UTC()
+	return cert, nil
+}
+
+// NewCertificate collects the subject names and metadata of x509Cert. The log, index and timestamp are left to
+// the caller.
+func NewCertificate(x509Cert *x509.Certificate, precert bool) Certificate {
+	cert := Certificate{
+		Subjects:             append([]string{x509Cert.Subject.CommonName}, x509Cert.DNSNames...),
+		Issuer:               x509Cert.Issuer.String(),
+		NotBefore:            x509Cert.NotBefore.UTC(),
+		NotAfter:             x509Cert.NotAfter.UTC(),
+		Precert:              precert,
+		PublicKeyFingerprint: fmt.Sprintf("%x", sha256.Sum256(x509Cert.RawSubjectPublicKeyInfo)),
+		EmailAddresses:       strings.Join(x509Cert.EmailAddresses, ","),
+	}
+	if x509Cert.SerialNumber != nil {
+		cert.Serial = x509Cert.SerialNumber.Text(16)
+	}
+	ips := make([]string, len(x509Cert.IPAddresses))
+	for i, ip := range x509Cert.IPAddresses {
+		ips[i] = ip.String()
+	}
+	cert.IPAddresses = strings.Join(ips, ",")
+	cert.Subjects = Unique(cert.Subjects)
+	return cert
+}
+
+func getRawEntriesWithRetries(ctx context.Context, config *CTConfig, c LogClient, start, end int64) (*ct.GetEntriesResponse, error) {
+	var resp *ct.GetEntriesResponse
+	var err error
+	for i := 0; i < config.GetEntriesRetries; i++ {
+		if i > 0 {
+			sleepErr := SleepContext(ctx, Backoff(i-1, err))
+			if sleepErr != nil {
+				return nil, sleepErr
+			}
+		}
+		resp, err = c.GetRawEntries(ctx, start, end)
+		if err == nil && len(resp.Entries) == 0 {
+			err = errors.New("empty get-entries response")
+		}
+		if err == nil {
+			return resp, nil
+		}
 	}
+	return nil, err
+}
+
+// CTProcessWorker fetches the requested ranges. Logs may return fewer entries than requested, so every range is
+// requested in pieces until it is covered completely. The largest truncated response is remembered as the log's
+// batch size.
+func CTProcessWorker(config *CTConfig, limiters map[int]*LogLimiter, requestChan <-chan CTRequest, batchChan chan<- CTBatch) {
+	clients := make(map[int]LogClient)
+	batchSizes := make(map[int]int64)
 	for {
-		start, ok := <-startChan
+		request, ok := <-requestChan
 		if !ok {
 			return
 		}
-		end := start + config.GetEntriesBatchSize + 1
-		var entries []ct.LogEntry
-
-		for i := 0; i < config.GetEntriesRetries; i++ {
-			entries, err = c.GetEntries(ctx, start, end)
-			if err == nil {
-				break
+		if request.Ctx.Err() != nil {
+			// ingestion from this log was stopped
+			continue
+		}
+		c, ok := clients[request.Log.ID]
+		if !ok {
+			var err error
+			c, err = ConnectLog(config, request.Log, limiters[request.Log.ID])
+			if err != nil {
+				log.Fatal().Err(err).Str("log", request.Log.URL).Msg("could not connect to log")
 			}
-			time.Sleep(1)
-
+			clients[request.Log.ID] = c
+			batchSizes[request.Log.ID] = request.Log.BatchSize
 		}
+		batch := fetchRange(config, c, request, batchSizes[request.Log.ID])
+		if batch.BatchSize > 0 {
+			batchSizes[request.Log.ID] = batch.BatchSize
+		}
+		batchChan <- batch
+	}
+}
+
+// fetchRange fetches the entries of request from c. Every piece asks for the whole remainder of the range, because
+// a log truncates responses for many reasons, such as tile alignment or the end of its tree, and a smaller request
+// could never show that the log returns more. If a truncated response is larger than batchSize, its length is
+// returned as the batch size.
+func fetchRange(config *CTConfig, c LogClient, request CTRequest, batchSize int64) CTBatch {
+	batch := CTBatch{Log: request.Log, Start: request.Start, Certificates: make([]Certificate, 0, request.End-request.Start+1)}
+	next := request.Start
+	for next <= request.End && batch.Err == nil && batch.VerifyErr == nil {
+		resp, err := getRawEntriesWithRetries(request.Ctx, config, c, next, request.End)
 		if err != nil {
-			log.Error().Err(err).Msg("error in get-entries")
+			batch.Err = err
+			break
 		}
-		certs := make([]Certificate, len(entries))
-		for i, entry := range entries {
-			certs[i] = Certificate{Index: entry.Index, Subjects: make([]string, 0)}
-			if entry.Leaf.LeafType != ct.TimestampedEntryLeafType {
-				log.Fatal().Msg("not a timestamped entry")
-			}
-			if entry.Leaf.TimestampedEntry.EntryType == ct.X509LogEntryType {
-				cert, err := entry.Leaf.X509Certificate()
-				if err != nil {
-					log.Fatal().Err(err).Msg("could not parse certificate")
-				}
-				certs[i].Subjects = append(certs[i].Subjects, cert.Subject.CommonName)
-				for _, name := range cert.DNSNames {
-					certs[i].Subjects = append(certs[i].Subjects, name)
-				}
-			} else if entry.Leaf.TimestampedEntry.EntryType == ct.PrecertLogEntryType {
-				precert, err := entry.Leaf.Precertificate()
-				if err != nil {
-					log.Fatal().Err(err)
-				}
-				certs[i].Subjects = append(certs[i].Subjects, precert.Subject.CommonName)
-				for _, name := range precert.DNSNames {
-					certs[i].Subjects = append(certs[i].Subjects, name)
+		if int64(len(resp.Entries)) > request.End-next+1 {
+			resp.Entries = resp.Entries[:request.End-next+1]
+		} else if n := int64(len(resp.Entries)); n < request.End-next+1 && n > batchSize {
+			batchSize = n
+			batch.BatchSize = n
+		}
+		for i, leafEntry := range resp.Entries {
+			index := next + int64(i)
+			if config.VerifyInclusion {
+				err = VerifyInclusion(request.Ctx, c, request.Log, index, leafEntry.LeafInput)
+				if errors.Is(err, ErrProofUnavailable) {
+					// the rest of the range is fetched again later
+					batch.Err = err
+					break
+				} else if err != nil {
+					batch.VerifyErr = errors.Wrapf(err, "inclusion of entry %d", index)
+					break
 				}
-			} else {
-				log.Fatal().Uint64("type", uint64(entry.Leaf.TimestampedEntry.EntryType)).Msg("unknown entry type")
 			}
-			certs[i].Subjects = Unique(certs[i].Subjects)
+			cert, err := ParseLeafEntry(request.Log.ID, index, &leafEntry)
+			if err != nil {
+				log.Warn().Err(err).Str("log", request.Log.URL).Int64("index", index).Msg("quarantining entry")
+				batch.BadEntries = append(batch.BadEntries, NewBadEntry(request.Log.ID, index, &leafEntry, err))
+				continue
+			}
+			batch.Certificates = append(batch.Certificates, cert)
 		}
-		certChan <- certs
+		next += int64(len(resp.Entries))
+	}
+	batch.End = batch.Start + int64(len(batch.Certificates)+len(batch.BadEntries)) - 1
+	if batch.VerifyErr != nil {
+		// nothing from a batch that failed verification is stored
+		batch.Certificates = nil
+		batch.BadEntries = nil
 	}
+	return batch
 }
 
-func CTOutputWorker(config *CTConfig, certChan <-chan []Certificate) {
+// CTOutputWorker stores the fetched batches. If sink is not nil, it receives the hosts of the certificates in each
+// batch.
+func CTOutputWorker(config *CTConfig, cancels map[int]context.CancelFunc, sink func([]Host), batchChan <-chan CTBatch) {
 	db, err := NewDatabase()
 	if err != nil {
 		log.Fatal().Err(err).Msg("could not create database")
 	}
 	defer db.Close()
+	err = db.SetIngestRules(&config.Ingest)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid ingest rules")
+	}
 
+	batchSizes := make(map[int]int64)
 	k := 0
 	for {
-		certs, ok := <-certChan
+		batch, ok := <-batchChan
 		if !ok {
 			return
 		}
-		if int64(len(certs)) != config.GetEntriesBatchSize {
-			log.Warn().Int64("expected", config.GetEntriesBatchSize).Int("received", len(certs)).Msg("not exactly GetEntriesBatchSize certificates arrived")
+		if batch.VerifyErr != nil {
+			log.Error().Err(batch.VerifyErr).Str("log", batch.Log.URL).Msg("log failed verification, stopping ingestion")
+			cancels[batch.Log.ID]()
+			err = db.SetVerificationError(batch.Log, batch.VerifyErr)
+			if err != nil {
+				log.Fatal().Err(err).Msg("could not store verification error")
+			}
+			continue
+		}
+		if batch.Err != nil {
+			// the rest of the range stays unfetched and is picked up by FillGaps
+			log.Error().Err(batch.Err).Str("log", batch.Log.URL).Int64("after", batch.End).Msg("error in get-entries")
+		}
+		if batch.BatchSize > batchSizes[batch.Log.ID] {
+			batchSizes[batch.Log.ID] = batch.BatchSize
+			log.Info().Str("log", batch.Log.URL).Int64("batch_size", batch.BatchSize).Msg("learned batch size")
+			err = db.SetBatchSize(batch.Log, batch.BatchSize)
+			if err != nil {
+				log.Fatal().Err(err).Msg("could not store batch size")
+			}
+		}
+		if len(batch.Certificates) == 0 && len(batch.BadEntries) == 0 {
+			continue
 		}
-		k += len(certs)
-		err = db.StoreCertificates(certs)
+		k += len(batch.Certificates)
+		var hosts []Host
+		hosts, err = db.StoreBatch(&batch)
 		if err != nil {
 			log.Fatal().Err(err).Msg("could not store certificates")
 
 		}
 		log.Debug().Int("certs", k).Msg("processed certs")
+		if sink != nil && len(hosts) > 0 {
+			sink(hosts)
+		}
+	}
+}
+
+// UpdateVerifiedSTH fetches the current STH of ctLog and stores it if it is signed by the log and consistent with
+// the last one stored. An older STH that is consistent with the stored one is skipped and the stored one is
+// returned instead. Verification failures are recorded in the database.
+func UpdateVerifiedSTH(ctx context.Context, config *CTConfig, db *Database, ctLog *CTLog) (*ct.SignedTreeHead, error) {
+	if ctLog.VerificationError != "" {
+		return nil, errors.Errorf("log failed verification before: %s", ctLog.VerificationError)
+	}
+	if len(ctLog.PublicKey) == 0 {
+		log.Warn().Str("log", ctLog.URL).Msg("no public key for log, not verifying sth")
+	}
+	c, err := ConnectLog(config, ctLog, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to log")
+	}
+	sth, err := c.GetSTH(ctx)
+	if errors.Is(err, ErrInvalidSTH) || errors.Is(err, ErrInvalidCheckpoint) {
+		// the log answered, but the sth could not be converted or its signature is invalid
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not get sth")
+	} else {
+		err = VerifyConsistency(ctx, c, ctLog, sth)
+		if errors.Is(err, ErrStaleSTH) {
+			log.Debug().Err(err).Str("log", ctLog.URL).Msg("skipping older sth")
+			return storedSTH(ctLog)
+		} else if errors.Is(err, ErrProofUnavailable) {
+			return nil, err
+		}
+	}
+	if err != nil {
+		storeErr := db.SetVerificationError(ctLog, err)
+		if storeErr != nil {
+			log.Fatal().Err(storeErr).Msg("could not store verification error")
+		}
+		return nil, errors.Wrap(err, "log failed verification")
+	}
+	err = db.UpdateSTH(ctLog, sth)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not store sth")
 	}
+	return sth, nil
 }
 
-func CTInputWorker(config *CTConfig, startChan chan<- int64) {
-	defer close(startChan)
+// storedSTH returns the last verified STH stored for ctLog.
+func storedSTH(ctLog *CTLog) (*ct.SignedTreeHead, error) {
+	sth := &ct.SignedTreeHead{Version: ct.V1, TreeSize: ctLog.TreeSize, Timestamp: ctLog.Timestamp}
+	copy(sth.SHA256RootHash[:], ctLog.RootHash)
+	_, err := tls.Unmarshal(ctLog.Signature, &sth.TreeHeadSignature)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse stored sth signature")
+	}
+	return sth, nil
+}
 
+// CTInputWorker emits the batches to fetch from a single log. It first catches up to the current STH from the
+// highest index fetched so far and then walks backwards from the lowest one. Nothing is fetched unless the STH
+// is signed by the log and consistent with the last one stored.
+func CTInputWorker(ctx context.Context, config *CTConfig, ctLog *CTLog, requestChan chan<- CTRequest) {
 	db, err := NewDatabase()
 	if err != nil {
 		log.Fatal().Err(err).Msg("could not open database")
 	}
-	minIndex, maxIndex, err := db.IndexRange()
+	defer db.Close()
+	minIndex, maxIndex, err := db.IndexRange(ctLog)
 	if err != nil {
 		log.Fatal().Err(err).Msg("could not get index range")
 	}
-	ctx := context.Background()
-	c, err := ConnectLog(config)
-	if err != nil {
-		log.Fatal().Err(err)
-	}
-	sth, err := c.GetSTH(ctx)
+	sth, err := UpdateVerifiedSTH(ctx, config, &db, ctLog)
 	if err != nil {
-		log.Fatal().Err(err)
+		log.Error().Err(err).Str("log", ctLog.URL).Msg("skipping log")
+		return
 	}
 
 	numCerts := int64(0)
 
 	maxLogIndex := int64(sth.TreeSize - 1)
+	size := requestSize(config, ctLog)
+
+	send := func(index int64) bool {
+		return sendCTRequest(ctx, requestChan, CTRequest{Ctx: ctx, Log: ctLog, Start: index, End: index + size - 1})
+	}
 
 	// catch up
 	index := maxIndex + 1
-	log.Info().Int64("certs", maxLogIndex-index+1).Msg("catching up to sth")
-	for index <= maxLogIndex-int64(config.GetEntriesBatchSize) {
-		startChan <- index
-		index += config.GetEntriesBatchSize
-		numCerts += config.GetEntriesBatchSize
+	log.Info().Str("log", ctLog.URL).Int64("certs", maxLogIndex-index+1).Msg("catching up to sth")
+	for index <= maxLogIndex-size {
+		if !send(index) {
+			return
+		}
+		index += size
+		numCerts += size
 		if numCerts >= config.NumCerts {
 			return
 		}
 	}
-	log.Info().Msg("done catching up")
+	log.Info().Str("log", ctLog.URL).Msg("done catching up")
 
 	// go back
-	index = maxLogIndex - (maxLogIndex % int64(config.GetEntriesBatchSize)) - int64(config.GetEntriesBatchSize)
+	index = maxLogIndex - (maxLogIndex % size) - size
 	if minIndex < maxLogIndex {
-		index = minIndex - 256
+		index = minIndex - size
 	}
 	for index >= 0 {
-		startChan <- index
-		index -= config.GetEntriesBatchSize
-		numCerts += config.GetEntriesBatchSize
+		if !send(index) {
+			return
+		}
+		index -= size
+		numCerts += size
 		if numCerts >= config.NumCerts {
 			return
 		}
 	}
 }
 
+// requestSize returns the number of entries to request from ctLog at once. This is the batch size learned from the
+// log if there is one, and GetEntriesBatchSize otherwise.
+func requestSize(config *CTConfig, ctLog *CTLog) int64 {
+	if ctLog.BatchSize > 0 {
+		return ctLog.BatchSize
+	}
+	return config.GetEntriesBatchSize
+}
+
+func sendCTRequest(ctx context.Context, requestChan chan<- CTRequest, request CTRequest) bool {
+	select {
+	case requestChan <- request:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// CTGapsInputWorker emits batches for all entries of a single log that are below the current STH but have not
+// been fetched yet.
+func CTGapsInputWorker(ctx context.Context, config *CTConfig, ctLog *CTLog, requestChan chan<- CTRequest) {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	_, err = UpdateVerifiedSTH(ctx, config, &db, ctLog)
+	if err != nil {
+		log.Error().Err(err).Str("log", ctLog.URL).Msg("skipping log")
+		return
+	}
+	gaps, err := db.GetGaps(ctLog)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not get gaps")
+	}
+	log.Info().Str("log", ctLog.URL).Int("gaps", len(gaps)).Msg("filling gaps")
+	size := requestSize(config, ctLog)
+	for _, gap := range gaps {
+		for start := gap.StartIndex; start <= gap.EndIndex; start += size {
+			end := start + size - 1
+			if end > gap.EndIndex {
+				end = gap.EndIndex
+			}
+			if !sendCTRequest(ctx, requestChan, CTRequest{Ctx: ctx, Log: ctLog, Start: start, End: end}) {
+				return
+			}
+		}
+	}
+}
+
+// ListGaps logs the unfetched ranges of every configured log below its last stored STH.
+func ListGaps(config *CTConfig) {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	for _, logConfig := range config.Logs {
+		ctLog, err := db.GetOrCreateCTLog(&logConfig)
+		if err != nil {
+			log.Fatal().Err(err).Str("log", logConfig.URL).Msg("could not get log")
+		}
+		gaps, err := db.GetGaps(&ctLog)
+		if err != nil {
+			log.Fatal().Err(err).Str("log", logConfig.URL).Msg("could not get gaps")
+		}
+		if len(gaps) == 0 {
+			log.Info().Str("log", ctLog.URL).Uint64("tree_size", ctLog.TreeSize).Msg("log is complete")
+		}
+		for _, gap := range gaps {
+			log.Info().Str("log", ctLog.URL).Int64("start", gap.StartIndex).Int64("end", gap.EndIndex).Int64("entries", gap.EndIndex-gap.StartIndex+1).Msg("gap")
+		}
+	}
+}
+
+// ListVerificationErrors logs the logs that failed verification and are skipped.
+func ListVerificationErrors() {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	ctLogs, err := db.GetVerificationErrors()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not get verification errors")
+	}
+	if len(ctLogs) == 0 {
+		log.Info().Msg("no log failed verification")
+	}
+	for _, ctLog := range ctLogs {
+		log.Info().Str("log", ctLog.URL).Uint64("tree_size", ctLog.TreeSize).Str("error", ctLog.VerificationError).Msg("log failed verification")
+	}
+}
+
+// ClearVerificationError makes the log at url trusted again. Its stored STH is kept, so the next STH still has to
+// be consistent with it.
+func ClearVerificationError(url string) {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	cleared, err := db.ClearVerificationError(url)
+	if err != nil {
+		log.Fatal().Err(err).Str("log", url).Msg("could not clear verification error")
+	}
+	if !cleared {
+		log.Fatal().Str("log", url).Msg("no log with this url failed verification")
+	}
+	log.Info().Str("log", url).Msg("cleared verification error")
+}
+
+// CTTailInputWorker follows a single log. It polls the STH every TailInterval and emits batches for all entries
+// that were added since the last poll, starting at the current tree size if nothing was fetched from the log yet.
+func CTTailInputWorker(ctx context.Context, config *CTConfig, ctLog *CTLog, requestChan chan<- CTRequest) {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	_, maxIndex, err := db.IndexRange(ctLog)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not get index range")
+	}
+	next := maxIndex + 1
+
+	ticker := time.NewTicker(time.Duration(config.TailInterval))
+	defer ticker.Stop()
+	for {
+		sth, err := UpdateVerifiedSTH(ctx, config, &db, ctLog)
+		if err != nil && ctLog.VerificationError != "" {
+			log.Error().Err(err).Str("log", ctLog.URL).Msg("stopped following log")
+			return
+		} else if err != nil {
+			log.Error().Err(err).Str("log", ctLog.URL).Msg("could not update sth")
+		} else {
+			treeSize := int64(sth.TreeSize)
+			if next > treeSize {
+				next = treeSize
+			}
+			if next < treeSize {
+				log.Debug().Str("log", ctLog.URL).Int64("certs", treeSize-next).Msg("new entries")
+			}
+			// the process workers may have learned a batch size since the last poll
+			err = db.LoadBatchSize(ctLog)
+			if err != nil {
+				log.Fatal().Err(err).Msg("could not load batch size")
+			}
+			// process workers get their own copy, so they do not race with the next sth update
+			snapshot := *ctLog
+			size := requestSize(config, ctLog)
+			for ; next < treeSize; next += size {
+				end := next + size - 1
+				if end >= treeSize {
+					end = treeSize - 1
+				}
+				if !sendCTRequest(ctx, requestChan, CTRequest{Ctx: ctx, Log: &snapshot, Start: next, End: end}) {
+					return
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 const CTWorkers = 30
 
+// ImportCertificates fetches certificates from all configured logs at once. Every log resumes from its own
+// fetched range, while all of them share the process workers and a single output worker that stores the batches.
 func ImportCertificates(config *CTConfig) {
-	Fan[int64, []Certificate]{
-		InputWorker: func(inputChan chan<- int64) {
-			CTInputWorker(config, inputChan)
+	runCTImport(config, CTInputWorker, nil)
+}
+
+// FillGaps fetches all entries that are missing below the current STH of each configured log.
+func FillGaps(config *CTConfig) {
+	runCTImport(config, CTGapsInputWorker, nil)
+}
+
+// TailCertificates follows all configured logs until each of them fails verification, which usually means it
+// never returns. The hosts of new entries are passed to sink as soon as they are stored.
+func TailCertificates(config *CTConfig, sink func([]Host)) {
+	runCTImport(config, CTTailInputWorker, sink)
+}
+
+func runCTImport(config *CTConfig, inputWorker func(context.Context, *CTConfig, *CTLog, chan<- CTRequest), sink func([]Host)) {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	ctLogs := make([]CTLog, len(config.Logs))
+	for i, logConfig := range config.Logs {
+		ctLogs[i], err = db.GetOrCreateCTLog(&logConfig)
+		if err != nil {
+			log.Fatal().Err(err).Str("log", logConfig.URL).Msg("could not get log")
+		}
+	}
+	db.Close()
+
+	contexts := make(map[int]context.Context)
+	cancels := make(map[int]context.CancelFunc)
+	limiters := make(map[int]*LogLimiter)
+	for _, ctLog := range ctLogs {
+		contexts[ctLog.ID], cancels[ctLog.ID] = context.WithCancel(context.Background())
+		limiters[ctLog.ID] = NewLogLimiter(config.RequestsPerSecond, CTWorkers)
+	}
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	Fan[CTRequest, CTBatch]{
+		InputWorker: func(inputChan chan<- CTRequest) {
+			var wg sync.WaitGroup
+			wg.Add(len(ctLogs))
+			for i := range ctLogs {
+				ctLog := &ctLogs[i]
+				go func() {
+					inputWorker(contexts[ctLog.ID], config, ctLog, inputChan)
+					wg.Done()
+				}()
+			}
+			wg.Wait()
+			close(inputChan)
 		},
-		ProcessWorker: func(inputChan <-chan int64, outputChan chan<- []Certificate) {
-			CTProcessWorker(config, inputChan, outputChan)
+		ProcessWorker: func(inputChan <-chan CTRequest, outputChan chan<- CTBatch) {
+			CTProcessWorker(config, limiters, inputChan, outputChan)
 		},
-		OutputWorker: func(outputChan <-chan []Certificate) {
-			CTOutputWorker(config, outputChan)
+		OutputWorker: func(outputChan <-chan CTBatch) {
+			CTOutputWorker(config, cancels, sink, outputChan)
 		},
 		Workers:      CTWorkers,
 		InputBuffer:  100,
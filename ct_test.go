@@ -0,0 +1,144 @@
+package scanct
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetSTHSeparatesInvalidFromFailed(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		body    string
+		invalid bool
+	}{
+		{"html from a proxy", "<html><body>502 Bad Gateway</body></html>", false},
+		{"truncated json", `{"tree_size": 12, "timestamp": 1`, false},
+		{"bad root hash", `{"tree_size": 12, "timestamp": 1, "sha256_root_hash": "AAAA", "tree_head_signature": "BAMARjBEAiA="}`, true},
+		{"bad signature", `{"tree_size": 12, "timestamp": 1, "sha256_root_hash": "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", "tree_head_signature": "BAMACDAGAgEBAgEB"}`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			c, err := ConnectLog(&CTConfig{}, &CTLog{URL: server.URL, PublicKey: publicKey}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = c.GetSTH(context.Background())
+			if err == nil {
+				t.Fatal("GetSTH succeeded")
+			}
+			if errors.Is(err, ErrInvalidSTH) != test.invalid {
+				t.Fatalf("errors.Is(%v, ErrInvalidSTH) = %t, want %t", err, !test.invalid, test.invalid)
+			}
+		})
+	}
+}
+
+// truncatingClient serves entries up to treeSize and ends every response at the next multiple of maxEntries, like
+// a log that serves get-entries from tiles.
+type truncatingClient struct {
+	LogClient
+	maxEntries int64
+	treeSize   int64
+	requests   [][2]int64
+}
+
+func (c *truncatingClient) GetRawEntries(_ context.Context, start, end int64) (*ct.GetEntriesResponse, error) {
+	c.requests = append(c.requests, [2]int64{start, end})
+	if limit := (start/c.maxEntries+1)*c.maxEntries - 1; end > limit {
+		end = limit
+	}
+	if end >= c.treeSize {
+		end = c.treeSize - 1
+	}
+	resp := &ct.GetEntriesResponse{}
+	for i := start; i <= end; i++ {
+		resp.Entries = append(resp.Entries, ct.LeafEntry{LeafInput: []byte{byte(i)}})
+	}
+	return resp, nil
+}
+
+func TestFetchRangeLearnsBatchSize(t *testing.T) {
+	config := &CTConfig{GetEntriesRetries: 1}
+	tests := []struct {
+		name      string
+		start     int64
+		end       int64
+		known     int64
+		treeSize  int64
+		wantSize  int64
+		wantCalls int
+	}{
+		// the first response ends at the tile boundary, the second one is the largest the log returns
+		{"unaligned start", 20, 99, 0, 1000, 32, 4},
+		// a response cut short by a small known size must not lower the batch size
+		{"smaller than known", 20, 60, 32, 1000, 0, 2},
+		{"not truncated", 0, 31, 0, 1000, 0, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &truncatingClient{maxEntries: 32, treeSize: test.treeSize}
+			request := CTRequest{Ctx: context.Background(), Log: &CTLog{}, Start: test.start, End: test.end}
+			batch := fetchRange(config, c, request, test.known)
+			if batch.BatchSize != test.wantSize {
+				t.Errorf("batch size = %d, want %d", batch.BatchSize, test.wantSize)
+			}
+			if len(c.requests) != test.wantCalls {
+				t.Errorf("requests = %v, want %d of them", c.requests, test.wantCalls)
+			}
+			for _, r := range c.requests {
+				if r[1] != test.end {
+					t.Errorf("request %v does not ask for the rest of the range up to %d", r, test.end)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestSizeUsesLearnedBatchSize(t *testing.T) {
+	db := testDatabase(t)
+	err := migrate(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &CTConfig{GetEntriesBatchSize: 256}
+	ctLog, err := db.GetOrCreateCTLog(&CTLogConfig{URL: "https://ct.example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := requestSize(config, &ctLog); size != 256 {
+		t.Errorf("request size without a learned batch size = %d, want 256", size)
+	}
+
+	err = db.SetBatchSize(&CTLog{ID: ctLog.ID}, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.LoadBatchSize(&ctLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := requestSize(config, &ctLog); size != 32 {
+		t.Errorf("request size with a learned batch size = %d, want 32", size)
+	}
+}
@@ -0,0 +1,394 @@
+package scanct
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gorm.io/gorm/clause"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testDatabase opens an empty SQLite database in a temporary directory. Foreign keys are enforced, like they are in
+// Postgres.
+func testDatabase(t *testing.T) Database {
+	return openTestDatabase(t, filepath.Join(t.TempDir(), "instances.db")+"?_foreign_keys=1")
+}
+
+// testLegacyDatabase opens an empty SQLite database that does not enforce foreign keys, like the databases created
+// before migrations. Migrating them recreates tables that others refer to.
+func testLegacyDatabase(t *testing.T) Database {
+	return openTestDatabase(t, filepath.Join(t.TempDir(), "instances.db"))
+}
+
+func openTestDatabase(t *testing.T, dsn string) Database {
+	SetDatabaseConfig(&DatabaseConfig{Driver: "sqlite", DSN: dsn})
+	db, err := openDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// createHosts creates a host for each of names and returns their IDs.
+func createHosts(t *testing.T, db *Database, names ...string) []int {
+	hosts := make([]Host, 0, len(names))
+	for _, name := range names {
+		hosts = append(hosts, Host{Name: name})
+	}
+	err := db.db.Create(&hosts).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int, 0, len(hosts))
+	for _, host := range hosts {
+		ids = append(ids, host.ID)
+	}
+	return ids
+}
+
+// createLegacyInstances creates instances, GitLab and Jenkins instances as they were stored before hosts were
+// added.
+func createLegacyInstances(t *testing.T, db *Database) {
+	type Instance struct {
+		ID        int
+		Name      string `gorm:"index:index_name"`
+		Index     int64  `gorm:"index:index_index"`
+		Processed bool
+	}
+	type GitLab struct {
+		ID          int
+		InstanceID  int
+		Instance    Instance `gorm:"foreignKey:InstanceID"`
+		AllowSignup bool
+		Email       string
+		Password    string
+		APIToken    string
+		Processed   bool
+		BaseURL     string `gorm:"uniqueIndex:git_labs_base_url"`
+	}
+	type Jenkins struct {
+		ID           int
+		InstanceID   int
+		Instance     Instance `gorm:"foreignKey:InstanceID"`
+		AnonymousAPI bool
+		BaseURL      string `gorm:"uniqueIndex:jenkins_base_url"`
+		Processed    bool
+		ScriptAccess bool
+	}
+	err := db.db.AutoMigrate(&Instance{}, &GitLab{}, &Jenkins{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []interface{}{
+		&[]Instance{
+			{ID: 1, Name: "*.Foo.example.com", Index: 10},
+			{ID: 2, Name: "foo.example.com", Index: 3, Processed: true},
+			{ID: 3, Name: "GitLab.Example.COM.", Index: 7},
+			{ID: 4, Name: "bücher.example", Index: 8},
+			{ID: 5, Name: "192.0.2.1", Index: 9},
+			{ID: 6, Name: "xn--bcher-kva.example", Index: 12},
+		},
+		&GitLab{InstanceID: 3, BaseURL: "https://gitlab.example.com"},
+		&Jenkins{InstanceID: 5, BaseURL: "https://192.0.2.1"},
+	} {
+		err = db.db.Omit(clause.Associations).Create(value).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackfillHostsNormalizesLegacyNames(t *testing.T) {
+	db := testLegacyDatabase(t)
+	createLegacyInstances(t, &db)
+	err := migrate(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hosts []Host
+	err = db.db.Order("name").Find(&hosts).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Host{
+		{Name: "foo.example.com", Domain: "example.com", Wildcard: true, FirstSeen: 3, LastSeen: 10, CertificateCount: 2, GitLabProcessed: true, JenkinsProcessed: true},
+		{Name: "gitlab.example.com", Domain: "example.com", FirstSeen: 7, LastSeen: 7, CertificateCount: 1},
+		{Name: "xn--bcher-kva.example", Domain: "xn--bcher-kva.example", FirstSeen: 8, LastSeen: 12, CertificateCount: 2},
+	}
+	hostIDs := make(map[string]int)
+	for i := range hosts {
+		hostIDs[hosts[i].Name] = hosts[i].ID
+		hosts[i].ID = 0
+	}
+	if fmt.Sprint(hosts) != fmt.Sprint(want) {
+		t.Fatalf("hosts = %+v, want %+v", hosts, want)
+	}
+
+	var instances []Instance
+	err = db.db.Order("id").Find(&instances).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, instance := range instances {
+		if instance.ID == 5 {
+			if instance.HostID != 0 {
+				t.Errorf("ip address instance is linked to host %d", instance.HostID)
+			}
+			continue
+		}
+		if instance.HostID == 0 || instance.HostID != hostIDs[instance.Name] {
+			t.Errorf("instance %d %q is linked to host %d", instance.ID, instance.Name, instance.HostID)
+		}
+	}
+	if instances[0].Name != "foo.example.com" || !instances[0].Wildcard || instances[0].Domain != "example.com" {
+		t.Errorf("wildcard instance = %+v", instances[0])
+	}
+
+	var gitLab GitLab
+	err = db.db.First(&gitLab).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gitLab.HostID != hostIDs["gitlab.example.com"] {
+		t.Errorf("gitlab is linked to host %d, want %d", gitLab.HostID, hostIDs["gitlab.example.com"])
+	}
+
+	var labels []string
+	err = db.db.Model(&HostLabel{}).Where("host_id = ?", hostIDs["gitlab.example.com"]).Pluck("label", &labels).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 1 || labels[0] != "gitlab" {
+		t.Errorf("labels of gitlab.example.com = %v, want [gitlab]", labels)
+	}
+}
+
+func TestStoreBatchWithManyNames(t *testing.T) {
+	db := testDatabase(t)
+	err := migrate(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctLog, err := db.GetOrCreateCTLog(&CTLogConfig{URL: "https://ct.example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more hosts and instances than fit into a single statement
+	batch := CTBatch{Log: &ctLog, Start: 0, End: 3}
+	for i := 0; i < 4; i++ {
+		cert := Certificate{CTLogID: ctLog.ID, Index: int64(i)}
+		for j := 0; j < 2500; j++ {
+			cert.Subjects = append(cert.Subjects, fmt.Sprintf("host%d.example%d.com", j, i%2))
+		}
+		batch.Certificates = append(batch.Certificates, cert)
+	}
+	hosts, err := db.StoreBatch(&batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 5000 {
+		t.Fatalf("stored %d hosts, want 5000", len(hosts))
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	if hosts[0].CertificateCount != 2 {
+		t.Errorf("host %s is in %d certificates, want 2", hosts[0].Name, hosts[0].CertificateCount)
+	}
+	var instances int64
+	err = db.db.Model(&Instance{}).Where("host_id <> 0").Count(&instances).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instances != 10000 {
+		t.Errorf("stored %d linked instances, want 10000", instances)
+	}
+}
+
+func TestClearVerificationError(t *testing.T) {
+	db := testDatabase(t)
+	err := migrate(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctLog, err := db.GetOrCreateCTLog(&CTLogConfig{URL: "https://ct.example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetVerificationError(&ctLog, errors.New("bad signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := db.GetVerificationErrors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].URL != ctLog.URL {
+		t.Fatalf("got %v logs that failed verification, want %s", failed, ctLog.URL)
+	}
+
+	cleared, err := db.ClearVerificationError(ctLog.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cleared {
+		t.Fatal("verification error was not cleared")
+	}
+	cleared, err = db.ClearVerificationError(ctLog.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cleared {
+		t.Error("cleared a log that did not fail verification")
+	}
+	failed, err = db.GetVerificationErrors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Errorf("got %d logs that failed verification, want 0", len(failed))
+	}
+}
+
+func TestFailedResolutionIsRetried(t *testing.T) {
+	db := testDatabase(t)
+	err := migrate(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := Host{Name: "gitlab.example.com"}
+	err = db.db.Create(&host).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher, err := NewCandidateMatcher(&CandidatePatterns{Prefixes: []string{"gitlab."}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.SaveResolutions([]Resolution{{HostID: host.ID, Status: DNSStatusError}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetHostProcessedForDNS(&host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unresolved, err := db.GetUnresolvedHosts(matcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unresolved) != 1 || unresolved[0].ID != host.ID {
+		t.Fatalf("got unresolved hosts %v, want %s", unresolved, host.Name)
+	}
+	candidates, err := db.GetUnprocessedHostsForGitlab(matcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 0 {
+		t.Errorf("got %d GitLab candidates whose lookup failed, want 0", len(candidates))
+	}
+
+	err = db.SaveResolutions([]Resolution{{HostID: host.ID, Status: DNSStatusResolved}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetHostProcessedForDNS(&host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unresolved, err = db.GetUnresolvedHosts(matcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unresolved) != 0 {
+		t.Errorf("got %d unresolved hosts after the lookup succeeded, want 0", len(unresolved))
+	}
+}
+
+func TestNormalizeLegacyHostsMergesBackfilledHosts(t *testing.T) {
+	db := testLegacyDatabase(t)
+	createLegacyInstances(t, &db)
+	for _, m := range migrations {
+		if m.Version >= 8 {
+			break
+		}
+		err := m.Up(db.db)
+		if err != nil {
+			t.Fatalf("migration %d: %v", m.Version, err)
+		}
+	}
+	// the backfill named hosts as in certificates, and the filter steps processed them since
+	var rawGitLab, rawJenkins Host
+	err := db.db.Where("name = ?", "GitLab.Example.COM.").First(&rawGitLab).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.db.Where("name = ?", "192.0.2.1").First(&rawJenkins).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.db.Model(&rawGitLab).Update("git_lab_processed", true).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.db.Table("jenkins").Where("true").Update("host_id", rawJenkins.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.db.Omit(clause.Associations).Create(&DNSRecord{HostID: rawGitLab.ID, Type: "A", Value: "192.0.2.7"}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want string
+	for i := 0; i < 2; i++ {
+		err = normalizeLegacyHosts(db.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hosts []Host
+		err = db.db.Order("name").Find(&hosts).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			want = fmt.Sprint(hosts)
+		} else if got := fmt.Sprint(hosts); got != want {
+			t.Fatalf("hosts changed when normalizing again: %s, want %s", got, want)
+		}
+	}
+
+	var gitLabHost Host
+	err = db.db.Where("name = ?", "gitlab.example.com").First(&gitLabHost).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gitLabHost.GitLabProcessed || gitLabHost.Domain != "example.com" || gitLabHost.CertificateCount != 1 {
+		t.Errorf("gitlab.example.com = %+v, want it processed with one certificate", gitLabHost)
+	}
+	var count int64
+	err = db.db.Model(&Host{}).Where("id in ?", []int{rawGitLab.ID, rawJenkins.ID}).Count(&count).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d hosts named as in certificates are left", count)
+	}
+	err = db.db.Model(&DNSRecord{}).Count(&count).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d dns records of merged hosts are left", count)
+	}
+	var jenkins Jenkins
+	err = db.db.First(&jenkins).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jenkins.HostID != 0 {
+		t.Errorf("jenkins of an ip address is linked to host %d", jenkins.HostID)
+	}
+}
@@ -0,0 +1,62 @@
+package dns
+
+import (
+	"context"
+	"github.com/rgwohlbold/scanct"
+	"github.com/rs/zerolog/log"
+)
+
+// ResolveStep resolves the candidates of the filter steps, so that they only probe hosts that exist. If Live is
+// set, it receives every candidate that resolved.
+type ResolveStep struct {
+	Resolver *Resolver
+	Matchers []*scanct.CandidateMatcher
+	Live     func(scanct.Candidate)
+}
+
+func (s ResolveStep) UnprocessedInputs(db *scanct.Database) ([]scanct.Candidate, error) {
+	return db.GetUnresolvedHosts(s.Matchers...)
+}
+
+func (s ResolveStep) Process(candidate *scanct.Candidate) ([]scanct.Resolution, error) {
+	resolution, err := s.Resolver.Resolve(context.Background(), candidate.Name)
+	if err != nil {
+		// the host is resolved again by the next run
+		log.Warn().Err(err).Str("host", candidate.Name).Msg("could not resolve host")
+		return []scanct.Resolution{{HostID: candidate.ID, Status: scanct.DNSStatusError}}, nil
+	}
+	resolution.HostID = candidate.ID
+	for i := range resolution.Records {
+		resolution.Records[i].HostID = candidate.ID
+	}
+	log.Debug().Str("host", candidate.Name).Str("status", resolution.Status).Int("records", len(resolution.Records)).Msg("resolved host")
+	if s.Live != nil && resolution.Status == scanct.DNSStatusResolved {
+		live := *candidate
+		live.DNSProcessed = true
+		live.DNSStatus = resolution.Status
+		s.Live(live)
+	}
+	return []scanct.Resolution{resolution}, nil
+}
+
+func (s ResolveStep) SetProcessed(db *scanct.Database, c *scanct.Candidate) error {
+	return db.SetHostProcessedForDNS(&c.Host)
+}
+
+func (s ResolveStep) SaveResult(db *scanct.Database, result []scanct.Resolution) error {
+	return db.SaveResolutions(result)
+}
+
+// ResolveHosts resolves all unresolved candidates of matchers with the resolver of config.
+func ResolveHosts(config *scanct.DNSConfig, matchers ...*scanct.CandidateMatcher) {
+	step := ResolveStep{Resolver: NewResolver(config), Matchers: matchers}
+	log.Info().Str("server", step.Resolver.Server).Msg("resolving hosts")
+	scanct.RunProcessStep[scanct.Candidate, scanct.Resolution](step, config.Workers)
+}
+
+// ResolveStream resolves the candidates received from candidates until the channel is closed and passes those that
+// resolved to live.
+func ResolveStream(config *scanct.DNSConfig, candidates <-chan scanct.Candidate, live func(scanct.Candidate)) {
+	step := ResolveStep{Resolver: NewResolver(config), Live: live}
+	scanct.RunProcessStepFrom[scanct.Candidate, scanct.Resolution](step, config.Workers, candidates)
+}
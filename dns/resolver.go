@@ -0,0 +1,183 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"github.com/rgwohlbold/scanct"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Resolver sends queries to a single recursive resolver. Unlike the resolver of package net, it tells NXDOMAIN
+// apart from names without records and returns the CNAME chain.
+type Resolver struct {
+	Server  string
+	Timeout time.Duration
+	Retries int
+}
+
+// systemServer returns the first nameserver of /etc/resolv.conf.
+func systemServer() string {
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+func NewResolver(config *scanct.DNSConfig) *Resolver {
+	server := config.Server
+	if server == "" {
+		server = systemServer()
+	} else if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &Resolver{Server: server, Timeout: time.Duration(config.Timeout), Retries: config.Retries}
+}
+
+func (r *Resolver) exchangeUDP(ctx context.Context, query []byte, id uint16) (dnsmessage.Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", r.Server)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(r.Timeout))
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	_, err = conn.Write(query)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	buffer := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return dnsmessage.Message{}, err
+		}
+		var response dnsmessage.Message
+		// stray responses to earlier queries are skipped
+		if response.Unpack(buffer[:n]) == nil && response.ID == id && response.Response {
+			return response, nil
+		}
+	}
+}
+
+func (r *Resolver) exchangeTCP(ctx context.Context, query []byte, id uint16) (dnsmessage.Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", r.Server)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(r.Timeout))
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	_, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...))
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	length := make([]byte, 2)
+	_, err = io.ReadFull(conn, length)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(length))
+	_, err = io.ReadFull(conn, data)
+	if err != nil {
+		return dnsmessage.Message{}, err
+	}
+	var response dnsmessage.Message
+	err = response.Unpack(data)
+	if err != nil {
+		return dnsmessage.Message{}, errors.Wrap(err, "could not parse response")
+	}
+	if response.ID != id {
+		return dnsmessage.Message{}, errors.New("response id does not match query")
+	}
+	return response, nil
+}
+
+// exchange sends a query for name and qtype. It is sent again over TCP if the response is truncated and over UDP
+// if it times out.
+func (r *Resolver) exchange(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) (dnsmessage.Message, error) {
+	id := uint16(rand.Uint32())
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return dnsmessage.Message{}, errors.Wrap(err, "could not create query")
+	}
+	for attempt := 0; ; attempt++ {
+		var response dnsmessage.Message
+		response, err = r.exchangeUDP(ctx, packed, id)
+		if err == nil && response.Truncated {
+			response, err = r.exchangeTCP(ctx, packed, id)
+		}
+		var netErr net.Error
+		if err == nil || !errors.As(err, &netErr) || !netErr.Timeout() || attempt >= r.Retries {
+			return response, err
+		}
+	}
+}
+
+// Resolve returns the status and the A, AAAA and CNAME records of name.
+func (r *Resolver) Resolve(ctx context.Context, name string) (scanct.Resolution, error) {
+	dnsName, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return scanct.Resolution{}, errors.Wrap(err, "invalid name")
+	}
+	var records []scanct.DNSRecord
+	seen := make(map[scanct.DNSRecord]bool)
+	addresses := 0
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		response, err := r.exchange(ctx, dnsName, qtype)
+		if err != nil {
+			return scanct.Resolution{}, errors.Wrapf(err, "could not query %s", qtype)
+		}
+		if response.RCode == dnsmessage.RCodeNameError {
+			return scanct.Resolution{Status: scanct.DNSStatusNXDomain}, nil
+		} else if response.RCode != dnsmessage.RCodeSuccess {
+			return scanct.Resolution{}, errors.Errorf("%s query failed with %s", qtype, response.RCode)
+		}
+		for _, answer := range response.Answers {
+			var record scanct.DNSRecord
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				record = scanct.DNSRecord{Type: "A", Value: net.IP(body.A[:]).String()}
+				addresses++
+			case *dnsmessage.AAAAResource:
+				record = scanct.DNSRecord{Type: "AAAA", Value: net.IP(body.AAAA[:]).String()}
+				addresses++
+			case *dnsmessage.CNAMEResource:
+				record = scanct.DNSRecord{Type: "CNAME", Value: strings.TrimSuffix(strings.ToLower(body.CNAME.String()), ".")}
+			default:
+				continue
+			}
+			if !seen[record] {
+				seen[record] = true
+				records = append(records, record)
+			}
+		}
+	}
+	status := scanct.DNSStatusResolved
+	if addresses == 0 {
+		status = scanct.DNSStatusNoData
+	}
+	return scanct.Resolution{Status: status, Records: records}, nil
+}
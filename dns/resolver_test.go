@@ -0,0 +1,188 @@
+package dns
+
+import (
+	"context"
+	"github.com/rgwohlbold/scanct"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// standIn is a DNS server on a local UDP port that answers from a fixed zone. Names in drop do not get an answer
+// to their first drop[name] queries.
+type standIn struct {
+	conn    net.PacketConn
+	mutex   sync.Mutex
+	drop    map[string]int
+	queries map[string]int
+}
+
+var zone = map[string][]dnsmessage.Resource{
+	"a.example.com.": {
+		aRecord("a.example.com.", 192, 0, 2, 1),
+		aRecord("a.example.com.", 192, 0, 2, 2),
+		aaaaRecord("a.example.com.", net.ParseIP("2001:db8::1")),
+	},
+	"www.example.com.": {
+		cnameRecord("www.example.com.", "Web.Example.com."),
+		cnameRecord("web.example.com.", "edge.cdn.example.net."),
+		aRecord("edge.cdn.example.net.", 198, 51, 100, 7),
+	},
+	"empty.example.com.": {},
+	"slow.example.com.": {
+		aRecord("slow.example.com.", 192, 0, 2, 9),
+	},
+}
+
+// serverFailures are the names that are answered with SERVFAIL.
+var serverFailures = map[string]bool{"broken.example.com.": true}
+
+func header(name string, qtype dnsmessage.Type) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET, TTL: 300}
+}
+
+func aRecord(name string, a, b, c, d byte) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypeA), Body: &dnsmessage.AResource{A: [4]byte{a, b, c, d}}}
+}
+
+func aaaaRecord(name string, ip net.IP) dnsmessage.Resource {
+	var aaaa [16]byte
+	copy(aaaa[:], ip.To16())
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypeAAAA), Body: &dnsmessage.AAAAResource{AAAA: aaaa}}
+}
+
+func cnameRecord(name, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: header(name, dnsmessage.TypeCNAME), Body: &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)}}
+}
+
+func newStandIn(t *testing.T, drop map[string]int) *standIn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &standIn{conn: conn, drop: drop, queries: make(map[string]int)}
+	go s.serve()
+	t.Cleanup(func() { _ = conn.Close() })
+	return s
+}
+
+func (s *standIn) serve() {
+	buffer := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if query.Unpack(buffer[:n]) != nil || len(query.Questions) != 1 {
+			continue
+		}
+		question := query.Questions[0]
+		name := strings.ToLower(question.Name.String())
+		s.mutex.Lock()
+		s.queries[name]++
+		dropped := s.queries[name] <= s.drop[name]
+		s.mutex.Unlock()
+		if dropped {
+			continue
+		}
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionDesired: true, RecursionAvailable: true},
+			Questions: query.Questions,
+		}
+		records, ok := zone[name]
+		if serverFailures[name] {
+			response.RCode = dnsmessage.RCodeServerFailure
+		} else if !ok {
+			response.RCode = dnsmessage.RCodeNameError
+		}
+		for _, record := range records {
+			// CNAMEs are part of the answer to every type
+			if record.Header.Type == question.Type || record.Header.Type == dnsmessage.TypeCNAME {
+				response.Answers = append(response.Answers, record)
+			}
+		}
+		packed, err := response.Pack()
+		if err != nil {
+			continue
+		}
+		_, _ = s.conn.WriteTo(packed, addr)
+	}
+}
+
+func (s *standIn) resolver(retries int) *Resolver {
+	return &Resolver{Server: s.conn.LocalAddr().String(), Timeout: 200 * time.Millisecond, Retries: retries}
+}
+
+func TestResolve(t *testing.T) {
+	s := newStandIn(t, nil)
+	tests := []struct {
+		name string
+		want scanct.Resolution
+	}{
+		{"a.example.com", scanct.Resolution{Status: scanct.DNSStatusResolved, Records: []scanct.DNSRecord{
+			{Type: "A", Value: "192.0.2.1"},
+			{Type: "A", Value: "192.0.2.2"},
+			{Type: "AAAA", Value: "2001:db8::1"},
+		}}},
+		{"www.example.com", scanct.Resolution{Status: scanct.DNSStatusResolved, Records: []scanct.DNSRecord{
+			{Type: "CNAME", Value: "web.example.com"},
+			{Type: "CNAME", Value: "edge.cdn.example.net"},
+			{Type: "A", Value: "198.51.100.7"},
+		}}},
+		{"empty.example.com", scanct.Resolution{Status: scanct.DNSStatusNoData}},
+		{"missing.example.com", scanct.Resolution{Status: scanct.DNSStatusNXDomain}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := s.resolver(0).Resolve(context.Background(), test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveRetriesAfterTimeout(t *testing.T) {
+	s := newStandIn(t, map[string]int{"slow.example.com.": 1})
+	got, err := s.resolver(1).Resolve(context.Background(), "slow.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := scanct.Resolution{Status: scanct.DNSStatusResolved, Records: []scanct.DNSRecord{{Type: "A", Value: "192.0.2.9"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	s = newStandIn(t, map[string]int{"slow.example.com.": 1})
+	_, err = s.resolver(0).Resolve(context.Background(), "slow.example.com")
+	if err == nil {
+		t.Error("resolved without retries although the first query timed out")
+	}
+}
+
+func TestResolveServerFailure(t *testing.T) {
+	s := newStandIn(t, nil)
+	_, err := s.resolver(0).Resolve(context.Background(), "broken.example.com")
+	if err == nil {
+		t.Fatal("resolved a name that failed with SERVFAIL")
+	}
+
+	step := ResolveStep{Resolver: s.resolver(0)}
+	candidate := scanct.Candidate{Host: scanct.Host{ID: 7, Name: "broken.example.com"}}
+	got, err := step.Process(&candidate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []scanct.Resolution{{HostID: 7, Status: scanct.DNSStatusError}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
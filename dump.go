@@ -0,0 +1,244 @@
+package scanct
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/tls"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DumpRecord is a line of a JSONL dump, in the format of a get-entries entry. Index is the index of the entry in
+// its log. Records without an index are numbered by their position in the dump.
+type DumpRecord struct {
+	ct.LeafEntry
+	Index *int64 `json:"index"`
+}
+
+// dumpReader reads the records of a dump and counts the bytes consumed, so that imports can resume after the
+// last stored record.
+type dumpReader struct {
+	reader    *bufio.Reader
+	offset    int64
+	nextIndex int64
+	der       bool
+}
+
+func (r *dumpReader) read(n int) ([]byte, error) {
+	data := make([]byte, n)
+	_, err := io.ReadFull(r.reader, data)
+	if err == io.ErrUnexpectedEOF {
+		return nil, errors.New("truncated certificate")
+	}
+	return data, err
+}
+
+// readDER reads a single DER encoded certificate.
+func (r *dumpReader) readDER() ([]byte, error) {
+	header, err := r.read(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != 0x30 {
+		return nil, errors.Errorf("expected certificate at offset %d", r.offset)
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		lengthBytes, err := r.read(length & 0x7f)
+		if err == io.EOF || length&0x7f > 4 {
+			return nil, errors.Errorf("invalid certificate length at offset %d", r.offset)
+		} else if err != nil {
+			return nil, err
+		}
+		header = append(header, lengthBytes...)
+		length = 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+	}
+	body, err := r.read(length)
+	if err == io.EOF {
+		return nil, errors.New("truncated certificate")
+	} else if err != nil {
+		return nil, err
+	}
+	return append(header, body...), nil
+}
+
+// next returns the next record as a get-entries entry. Certificates of DER dumps are wrapped in a leaf without a
+// timestamp. It returns io.EOF after the last record.
+func (r *dumpReader) next() (int64, ct.LeafEntry, error) {
+	index := r.nextIndex
+	if r.der {
+		der, err := r.readDER()
+		if err != nil {
+			return 0, ct.LeafEntry{}, err
+		}
+		leafInput, err := tls.Marshal(ct.MerkleTreeLeaf{
+			Version:  ct.V1,
+			LeafType: ct.TimestampedEntryLeafType,
+			TimestampedEntry: &ct.TimestampedEntry{
+				EntryType: ct.X509LogEntryType,
+				X509Entry: &ct.ASN1Cert{Data: der},
+			},
+		})
+		if err != nil {
+			return 0, ct.LeafEntry{}, errors.Wrap(err, "could not create leaf")
+		}
+		extraData, err := tls.Marshal(ct.CertificateChain{})
+		if err != nil {
+			return 0, ct.LeafEntry{}, errors.Wrap(err, "could not create extra data")
+		}
+		r.offset += int64(len(der))
+		r.nextIndex++
+		return index, ct.LeafEntry{LeafInput: leafInput, ExtraData: extraData}, nil
+	}
+	var line []byte
+	for len(bytes.TrimSpace(line)) == 0 {
+		read, err := r.reader.ReadBytes('\n')
+		if err == io.EOF && len(read) == 0 {
+			return 0, ct.LeafEntry{}, io.EOF
+		} else if err != nil && err != io.EOF {
+			return 0, ct.LeafEntry{}, err
+		}
+		r.offset += int64(len(read))
+		line = read
+	}
+	var record DumpRecord
+	err := json.Unmarshal(line, &record)
+	if err != nil {
+		return 0, ct.LeafEntry{}, errors.Wrapf(err, "could not parse record ending at offset %d", r.offset)
+	}
+	if record.Index != nil {
+		index = *record.Index
+	}
+	r.nextIndex = index + 1
+	return index, record.LeafEntry, nil
+}
+
+// openDump opens path and skips to offset in its decompressed content. Gzip compression is detected from the
+// content, as is whether the dump holds JSONL records or concatenated DER certificates.
+func openDump(path string, offset int64) (*os.File, *dumpReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not open dump")
+	}
+	var reader io.Reader = file
+	magic, err := bufio.NewReader(file).Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		_, err = file.Seek(0, io.SeekStart)
+		if err == nil {
+			reader, err = gzip.NewReader(file)
+		}
+		if err == nil {
+			_, err = io.CopyN(io.Discard, reader, offset)
+		}
+	} else {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, errors.Wrap(err, "could not skip to offset")
+	}
+	r := &dumpReader{reader: bufio.NewReaderSize(reader, 1<<20), offset: offset}
+	first, err := r.reader.Peek(1)
+	r.der = err == nil && first[0] == 0x30
+	return file, r, nil
+}
+
+// ImportDump stores the certificates of a local dump file as if they were fetched from a log. The dump is recorded
+// as a log with a file URL, whose entries go through the same parsing and storage as those of real logs. An
+// interrupted import resumes after the last batch stored.
+func ImportDump(config *CTConfig, path string) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not get absolute path")
+	}
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	err = db.SetIngestRules(&config.Ingest)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid ingest rules")
+	}
+	ctLog, err := db.GetOrCreateCTLog(&CTLogConfig{URL: "file://" + filepath.ToSlash(path)})
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not get log for dump")
+	}
+	dumpOffset, err := db.GetDumpOffset(&ctLog)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not get dump offset")
+	}
+	file, reader, err := openDump(path, dumpOffset.Offset)
+	if err != nil {
+		log.Fatal().Err(err).Str("dump", path).Msg("could not open dump")
+	}
+	defer file.Close()
+	reader.nextIndex = dumpOffset.NextIndex
+	log.Info().Str("dump", path).Int64("offset", reader.offset).Bool("der", reader.der).Msg("importing dump")
+
+	batch := CTBatch{Log: &ctLog}
+	k := 0
+	flush := func() {
+		if n := len(batch.Certificates) + len(batch.BadEntries); n > 0 {
+			_, err = db.StoreBatch(&batch)
+			if err != nil {
+				log.Fatal().Err(err).Msg("could not store certificates")
+			}
+			k += n
+			log.Debug().Int("certs", k).Msg("processed certs")
+		}
+		err = db.SetDumpOffset(&ctLog, reader.offset, reader.nextIndex)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not store dump offset")
+		}
+		batch = CTBatch{Log: &ctLog}
+	}
+	for {
+		offset, nextIndex := reader.offset, reader.nextIndex
+		index, leafEntry, err := reader.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatal().Err(err).Str("dump", path).Int64("offset", reader.offset).Msg("could not read dump")
+		}
+		size := len(batch.Certificates) + len(batch.BadEntries)
+		// batches are stored as ranges, so they have to be contiguous
+		if size > 0 && index != batch.End+1 {
+			current := reader.offset
+			reader.offset, reader.nextIndex = offset, nextIndex
+			flush()
+			reader.offset, reader.nextIndex = current, index+1
+			size = 0
+		}
+		if size == 0 {
+			batch.Start = index
+		}
+		batch.End = index
+		cert, err := ParseLeafEntry(ctLog.ID, index, &leafEntry)
+		if err != nil {
+			log.Warn().Err(err).Str("dump", path).Int64("index", index).Msg("quarantining entry")
+			batch.BadEntries = append(batch.BadEntries, NewBadEntry(ctLog.ID, index, &leafEntry, err))
+		} else {
+			if reader.der {
+				// the leaf was made up, so there is no log timestamp
+				cert.Timestamp = time.Time{}
+			}
+			batch.Certificates = append(batch.Certificates, cert)
+		}
+		if int64(size+1) >= config.GetEntriesBatchSize {
+			flush()
+		}
+	}
+	flush()
+	log.Info().Str("dump", path).Int("certs", k).Msg("done importing dump")
+}
@@ -0,0 +1,284 @@
+package scanct
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// KeyEnv holds the base64 encoded key that encrypts credentials. It takes precedence over the key file.
+const KeyEnv = "SCANCT_KEY"
+
+// encryptedPrefix starts every encrypted value. Values without it were stored before encryption was added.
+const encryptedPrefix = "enc:v1:"
+
+// encryptionKey is a 256-bit key encrypting the data keys of values. Its ID is stored with every value, so that
+// values can be decrypted with the right key while rekeying.
+type encryptionKey struct {
+	ID   string
+	AEAD cipher.AEAD
+}
+
+func newEncryptionKey(key []byte) (*encryptionKey, error) {
+	if len(key) != 32 {
+		return nil, errors.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &encryptionKey{ID: hex.EncodeToString(sum[:4]), AEAD: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// ParseKey decodes a base64 encoded key.
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode key")
+	}
+	if len(key) != 32 {
+		return nil, errors.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// ReadKeyFile reads a base64 encoded key from path.
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read key file")
+	}
+	return ParseKey(string(data))
+}
+
+// LoadKey returns the key from KeyEnv, or from keyFile if the variable is not set. It returns nil if neither is set.
+func LoadKey(keyFile string) ([]byte, error) {
+	if encoded := os.Getenv(KeyEnv); encoded != "" {
+		return ParseKey(encoded)
+	}
+	if keyFile != "" {
+		return ReadKeyFile(keyFile)
+	}
+	return nil, nil
+}
+
+var (
+	// currentKey encrypts new values.
+	currentKey *encryptionKey
+	// decryptionKeys decrypt stored values by key ID.
+	decryptionKeys = make(map[string]*encryptionKey)
+)
+
+// SetEncryptionKey makes key encrypt new values and decrypt stored ones. Without a key, credentials can neither be
+// stored nor read.
+func SetEncryptionKey(key []byte) error {
+	k, err := newEncryptionKey(key)
+	if err != nil {
+		return err
+	}
+	currentKey = k
+	decryptionKeys[k.ID] = k
+	return nil
+}
+
+// sealValue encrypts plaintext with a new random data key, which is itself encrypted with currentKey. The column is
+// authenticated, so that values cannot be moved to another column.
+func sealValue(plaintext string, column string) (string, error) {
+	if currentKey == nil {
+		return "", errors.Errorf("no encryption key, set %s or database.key_file", KeyEnv)
+	}
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return "", errors.Wrap(err, "could not create data key")
+	}
+	wrappedKey, err := sealBytes(currentKey.AEAD, dataKey, []byte(currentKey.ID))
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := sealBytes(aead, []byte(plaintext), []byte(column))
+	if err != nil {
+		return "", err
+	}
+	encoding := base64.RawStdEncoding
+	return fmt.Sprintf("%s%s:%s:%s", encryptedPrefix, currentKey.ID, encoding.EncodeToString(wrappedKey), encoding.EncodeToString(ciphertext)), nil
+}
+
+func sealBytes(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openBytes(aead cipher.AEAD, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], additionalData)
+}
+
+// openValue decrypts a value stored by sealValue. Values stored in plaintext before encryption was added are encrypted
+// by a migration, so any that are left are refused.
+func openValue(value string, column string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return "", errors.Errorf("value of %s is not encrypted, run scanct db migrate", column)
+	}
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed encrypted value")
+	}
+	key, ok := decryptionKeys[parts[0]]
+	if !ok {
+		return "", errors.Errorf("value is encrypted with unknown key %s, set %s or database.key_file", parts[0], KeyEnv)
+	}
+	encoding := base64.RawStdEncoding
+	wrappedKey, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.Wrap(err, "could not decode data key")
+	}
+	ciphertext, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.Wrap(err, "could not decode ciphertext")
+	}
+	dataKey, err := openBytes(key.AEAD, wrappedKey, []byte(key.ID))
+	if err != nil {
+		return "", errors.Wrap(err, "could not decrypt data key")
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openBytes(aead, ciphertext, []byte(column))
+	if err != nil {
+		return "", errors.Wrap(err, "could not decrypt value")
+	}
+	return string(plaintext), nil
+}
+
+// EncryptedSerializer encrypts string fields tagged with `gorm:"serializer:encrypted"`. Empty strings are stored
+// as they are.
+type EncryptedSerializer struct{}
+
+func encryptedColumn(field *schema.Field) string {
+	return field.Schema.Table + "." + field.DBName
+}
+
+func (EncryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var value string
+	switch v := dbValue.(type) {
+	case nil:
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return errors.Errorf("unsupported type %T for encrypted field %s", dbValue, field.Name)
+	}
+	plaintext, err := openValue(value, encryptedColumn(field))
+	if err != nil {
+		return errors.Wrapf(err, "could not decrypt %s", field.Name)
+	}
+	return field.Set(ctx, dst, plaintext)
+}
+
+func (EncryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	plaintext, ok := fieldValue.(string)
+	if !ok {
+		return nil, errors.Errorf("unsupported type %T for encrypted field %s", fieldValue, field.Name)
+	}
+	if plaintext == "" {
+		return "", nil
+	}
+	ciphertext, err := sealValue(plaintext, encryptedColumn(field))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not encrypt %s", field.Name)
+	}
+	return ciphertext, nil
+}
+
+func init() {
+	schema.RegisterSerializer("encrypted", EncryptedSerializer{})
+}
+
+// rekeyTable encrypts the columns of all rows of model with currentKey.
+func rekeyTable[T any](db *gorm.DB, columns ...string) (int, error) {
+	count := 0
+	var rows []T
+	err := db.Select(append([]string{"id"}, columns...)).FindInBatches(&rows, 1000, func(tx *gorm.DB, batch int) error {
+		for i := range rows {
+			err := db.Model(&rows[i]).Select(columns).Updates(&rows[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+		count += len(rows)
+		return nil
+	}).Error
+	return count, err
+}
+
+// Rekey encrypts all credentials with newKey. Values encrypted with the current key are decrypted first. Values
+// already encrypted with newKey are kept, so an interrupted rekey can be run again.
+func Rekey(newKey []byte) {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	err = SetEncryptionKey(newKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid key")
+	}
+	tables := []struct {
+		name  string
+		rekey func(*gorm.DB) (int, error)
+	}{
+		{"git_labs", func(tx *gorm.DB) (int, error) { return rekeyTable[GitLab](tx, "password", "api_token") }},
+		{"findings", func(tx *gorm.DB) (int, error) { return rekeyTable[Finding](tx, "secret") }},
+		{"jenkins_findings", func(tx *gorm.DB) (int, error) { return rekeyTable[JenkinsFinding](tx, "secret") }},
+		{"aws_keys", func(tx *gorm.DB) (int, error) { return rekeyTable[AWSKey](tx, "secret_key") }},
+	}
+	for _, table := range tables {
+		var count int
+		err = db.db.Transaction(func(tx *gorm.DB) error {
+			count, err = table.rekey(tx)
+			return err
+		})
+		if err != nil {
+			log.Fatal().Err(err).Str("table", table.name).Msg("could not rekey table")
+		}
+		log.Info().Str("table", table.name).Int("rows", count).Msg("rekeyed table")
+	}
+	log.Info().Str("key", currentKey.ID).Msg("rekeyed database")
+}
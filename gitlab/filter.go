@@ -21,14 +21,17 @@ const SignInURL = "/users/sign_in"
 const SignInMagicString = "<meta content=\"GitLab\" property=\"og:site_name\">"
 const RegisterMagicString = "<a data-qa-selector=\"register_link\" href=\"/users/sign_up\">Register now</a>"
 
-type FilterStep struct{}
+// FilterStep probes the hosts selected by Matcher for GitLab instances.
+type FilterStep struct {
+	Matcher *scanct.CandidateMatcher
+}
 
-func (g FilterStep) SetProcessed(db *scanct.Database, i *scanct.Instance) error {
-	return db.SetInstanceProcessed(i)
+func (g FilterStep) SetProcessed(db *scanct.Database, c *scanct.Candidate) error {
+	return db.SetHostProcessedForGitLab(&c.Host)
 }
 
-func (g FilterStep) UnprocessedInputs(db *scanct.Database) ([]scanct.Instance, error) {
-	return db.GetUnprocessedInstancesForGitlab()
+func (g FilterStep) UnprocessedInputs(db *scanct.Database) ([]scanct.Candidate, error) {
+	return db.GetUnprocessedHostsForGitlab(g.Matcher)
 }
 
 const DoRegister = false
@@ -91,7 +94,7 @@ func Signup(httpClient *http.Client, gl *scanct.GitLab) error {
 	} else if strings.Contains(string(body), "However, we could not sign you in because your account is awaiting approval from your GitLab administrator.") {
 		return errors.New("awaiting approval from admin")
 	}
-	client, err := gitlab.NewBasicAuthClient(RegisterUsername, password, gitlab.WithBaseURL(gl.URL()))
+	client, err := gitlab.NewBasicAuthClient(RegisterUsername, password, gitlab.WithBaseURL(gl.URL()), gitlab.WithHTTPClient(httpClient))
 	if err != nil {
 		return err
 	}
@@ -105,13 +108,18 @@ func Signup(httpClient *http.Client, gl *scanct.GitLab) error {
 	return nil
 }
 
-func (g FilterStep) Process(instance *scanct.Instance) ([]scanct.GitLab, error) {
+func (g FilterStep) Process(candidate *scanct.Candidate) ([]scanct.GitLab, error) {
+	host := &candidate.Host
 	client := http.Client{
-		Timeout: 5 * time.Second,
+		Timeout:   5 * time.Second,
+		Transport: scanct.Transport,
 	}
-	resp, err := client.Get(fmt.Sprintf("https://%s%s", instance.Name, SignInURL))
+	resp, err := client.Get(fmt.Sprintf("https://%s%s", host.Name, SignInURL))
+	var blocked *scanct.BlockedError
 	if err != nil {
-		if strings.Contains(err.Error(), "server gave HTTP response to HTTPS client") {
+		if errors.As(err, &blocked) {
+			return nil, nil
+		} else if strings.Contains(err.Error(), "server gave HTTP response to HTTPS client") {
 			return nil, nil
 		} else if strings.Contains(err.Error(), "tls: failed to verify certificate: x509:") {
 			return nil, nil
@@ -132,15 +140,16 @@ func (g FilterStep) Process(instance *scanct.Instance) ([]scanct.GitLab, error)
 		}
 		bodyStr := string(body)
 		if strings.Contains(bodyStr, SignInMagicString) {
-			log.Info().Str("instance", instance.Name).Msg("found gitlab instance")
+			log.Info().Str("instance", host.Name).Str("reason", candidate.Reason).Msg("found gitlab instance")
 			gl := scanct.GitLab{
-				InstanceID:  instance.ID,
+				HostID:      host.ID,
+				Reason:      candidate.Reason,
 				AllowSignup: strings.Contains(bodyStr, RegisterMagicString),
 				Email:       "",
 				Password:    "",
 				APIToken:    "",
 				Processed:   false,
-				BaseURL:     fmt.Sprintf("https://%s", instance.Name),
+				BaseURL:     fmt.Sprintf("https://%s", host.Name),
 			}
 			if gl.AllowSignup && DoRegister {
 				err = Signup(&client, &gl)
@@ -156,6 +165,21 @@ func (g FilterStep) SaveResult(db *scanct.Database, result []scanct.GitLab) erro
 	return db.AddGitLab(result)
 }
 
-func FilterInstances() {
-	scanct.RunProcessStep[scanct.Instance, scanct.GitLab](FilterStep{}, 50)
+// IsCandidate returns host as a candidate if it is live, unprocessed and matched by matcher, like
+// Database.GetUnprocessedHostsForGitlab.
+func IsCandidate(matcher *scanct.CandidateMatcher, host *scanct.Host) (scanct.Candidate, bool) {
+	if host.GitLabProcessed || !host.Live() {
+		return scanct.Candidate{}, false
+	}
+	reason, ok := matcher.Match(host)
+	return scanct.Candidate{Host: *host, Reason: reason}, ok
+}
+
+func FilterInstances(matcher *scanct.CandidateMatcher) {
+	scanct.RunProcessStep[scanct.Candidate, scanct.GitLab](FilterStep{Matcher: matcher}, 50)
+}
+
+// FilterStream probes the candidates received from candidates until the channel is closed.
+func FilterStream(candidates <-chan scanct.Candidate) {
+	scanct.RunProcessStepFrom[scanct.Candidate, scanct.GitLab](FilterStep{}, 50, candidates)
 }
@@ -16,7 +16,7 @@ func (r RepositoryStep) UnprocessedInputs(db *scanct.Database) ([]scanct.GitLab,
 }
 
 func (r RepositoryStep) Process(gl *scanct.GitLab) ([]scanct.Repository, error) {
-	client, err := gitlab.NewClient(gl.APIToken, gitlab.WithBaseURL(gl.URL()))
+	client, err := gitlab.NewClient(gl.APIToken, gitlab.WithBaseURL(gl.URL()), gitlab.WithHTTPClient(scanct.NewHTTPClient(0)))
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create gitlab client")
 	}
@@ -11,6 +11,7 @@ import (
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport/http"
 	"gopkg.in/src-d/go-git.v4/storage/memory"
 	"math/rand"
@@ -153,5 +154,8 @@ func (s SecretsStep) SaveResult(db *scanct.Database, findings []scanct.Finding)
 const CloneRepositoryTimeout = 30 * time.Second
 
 func ScanSecrets() {
+	// go-git has no per-clone transport, so clones go through the shared transport by replacing the default client
+	client.InstallProtocol("https", http.NewClient(scanct.NewHTTPClient(0)))
+	client.InstallProtocol("http", http.NewClient(scanct.NewHTTPClient(0)))
 	scanct.RunProcessStep[scanct.Repository, scanct.Finding](SecretsStep{}, runtime.NumCPU())
 }
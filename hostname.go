@@ -0,0 +1,98 @@
+package scanct
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"net"
+	"strings"
+)
+
+// Hostname is a subject name of a certificate after normalization. Name is lowercase ASCII with IDNs in punycode.
+// For wildcard names, the wildcard label is removed and Wildcard is set, so Name is the parent of the wildcard.
+// Domain is the registrable domain of Name according to the public suffix list.
+type Hostname struct {
+	Name     string
+	Wildcard bool
+	Domain   string
+}
+
+const maxHostnameLength = 253
+const maxLabelLength = 63
+
+var hostnameProfile = idna.New(idna.MapForLookup(), idna.Transitional(false), idna.StrictDomainName(false))
+
+func validLabel(label string) bool {
+	if len(label) == 0 || len(label) > maxLabelLength {
+		return false
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, c := range label {
+		// underscores are not valid in hostnames, but common in certificates
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeHostname turns a subject name into a Hostname. It returns an error for names that cannot be probed,
+// such as IP addresses, organization names in the common name and public suffixes.
+func NormalizeHostname(subject string) (Hostname, error) {
+	name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(subject)), ".")
+	if name == "" {
+		return Hostname{}, errors.New("empty name")
+	}
+	if net.ParseIP(name) != nil {
+		return Hostname{}, errors.New("ip address")
+	}
+	hostname := Hostname{}
+	if strings.HasPrefix(name, "*.") {
+		hostname.Wildcard = true
+		name = name[2:]
+	}
+	name, err := hostnameProfile.ToASCII(name)
+	if err != nil {
+		return Hostname{}, errors.Wrap(err, "invalid idn")
+	}
+	if len(name) > maxHostnameLength {
+		return Hostname{}, errors.New("name too long")
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return Hostname{}, errors.New("not a fully qualified name")
+	}
+	for _, label := range labels {
+		if !validLabel(label) {
+			return Hostname{}, errors.Errorf("invalid label %q", label)
+		}
+	}
+	hostname.Name = name
+	hostname.Domain, err = publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return Hostname{}, errors.Wrap(err, "no registrable domain")
+	}
+	return hostname, nil
+}
+
+// NormalizeHostnames normalizes subjects and drops the names that are invalid. Names that occur both as a wildcard
+// and without one are returned once, as a wildcard.
+func NormalizeHostnames(subjects []string) []Hostname {
+	hostnames := make([]Hostname, 0, len(subjects))
+	seen := make(map[string]int)
+	for _, subject := range subjects {
+		hostname, err := NormalizeHostname(subject)
+		if err != nil {
+			continue
+		}
+		if i, ok := seen[hostname.Name]; ok {
+			hostnames[i].Wildcard = hostnames[i].Wildcard || hostname.Wildcard
+			continue
+		}
+		seen[hostname.Name] = len(hostnames)
+		hostnames = append(hostnames, hostname)
+	}
+	return hostnames
+}
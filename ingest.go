@@ -0,0 +1,132 @@
+package scanct
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"regexp"
+	"strings"
+)
+
+// IngestRules decide which hostnames are stored. Names are matched after normalization, so they are lowercase
+// punycode without a wildcard label. A name is dropped if its TLD is denied, if it does not end in an allowed
+// suffix, or if it matches a drop regex. If any keep rule is set, the remaining names are only stored if they match
+// one of them. Without rules, all names are stored.
+type IngestRules struct {
+	// KeepPrefixes keeps names starting with one of the prefixes, e.g. "gitlab." keeps gitlab.example.com.
+	KeepPrefixes []string `json:"keep_prefixes"`
+	KeepRegexes  []string `json:"keep_regexes"`
+	DropRegexes  []string `json:"drop_regexes"`
+	// SuffixAllowlist drops all names that are not equal to or below one of the suffixes, if set.
+	SuffixAllowlist []string `json:"suffix_allowlist"`
+	TLDDenylist     []string `json:"tld_denylist"`
+}
+
+// HostFilter evaluates compiled IngestRules.
+type HostFilter struct {
+	keepPrefixes []string
+	keepRegexes  []*regexp.Regexp
+	dropRegexes  []*regexp.Regexp
+	suffixes     []string
+	deniedTLDs   map[string]bool
+}
+
+func compileRegexes(patterns []string) ([]*regexp.Regexp, error) {
+	regexes := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid regex %q", pattern)
+		}
+		regexes = append(regexes, regex)
+	}
+	return regexes, nil
+}
+
+func normalizeSuffix(suffix string) string {
+	return strings.Trim(strings.ToLower(strings.TrimSpace(suffix)), ".")
+}
+
+func NewHostFilter(rules *IngestRules) (*HostFilter, error) {
+	keepRegexes, err := compileRegexes(rules.KeepRegexes)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not compile keep regexes")
+	}
+	dropRegexes, err := compileRegexes(rules.DropRegexes)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not compile drop regexes")
+	}
+	filter := &HostFilter{
+		keepRegexes: keepRegexes,
+		dropRegexes: dropRegexes,
+		deniedTLDs:  make(map[string]bool, len(rules.TLDDenylist)),
+	}
+	for _, prefix := range rules.KeepPrefixes {
+		filter.keepPrefixes = append(filter.keepPrefixes, strings.ToLower(strings.TrimSpace(prefix)))
+	}
+	for _, suffix := range rules.SuffixAllowlist {
+		filter.suffixes = append(filter.suffixes, normalizeSuffix(suffix))
+	}
+	for _, tld := range rules.TLDDenylist {
+		filter.deniedTLDs[normalizeSuffix(tld)] = true
+	}
+	return filter, nil
+}
+
+// Keep reports whether hostname is stored. If it is dropped, rule names the rule that dropped it.
+func (f *HostFilter) Keep(hostname *Hostname) (keep bool, rule string) {
+	if f == nil {
+		return true, ""
+	}
+	name := hostname.Name
+	tld := name[strings.LastIndexByte(name, '.')+1:]
+	if f.deniedTLDs[tld] {
+		return false, "tld_denylist:" + tld
+	}
+	if len(f.suffixes) > 0 {
+		allowed := false
+		for _, suffix := range f.suffixes {
+			if name == suffix || strings.HasSuffix(name, "."+suffix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false, "suffix_allowlist"
+		}
+	}
+	for _, regex := range f.dropRegexes {
+		if regex.MatchString(name) {
+			return false, "drop_regex:" + regex.String()
+		}
+	}
+	if len(f.keepPrefixes) == 0 && len(f.keepRegexes) == 0 {
+		return true, ""
+	}
+	for _, prefix := range f.keepPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true, ""
+		}
+	}
+	for _, regex := range f.keepRegexes {
+		if regex.MatchString(name) {
+			return true, ""
+		}
+	}
+	return false, "no_keep_rule"
+}
+
+// ListDroppedNames logs how many names each ingest rule dropped.
+func ListDroppedNames() {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	droppedNames, err := db.GetDroppedNames()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not get dropped names")
+	}
+	for _, droppedName := range droppedNames {
+		log.Info().Str("rule", droppedName.Rule).Int64("count", droppedName.Count).Msg("dropped names")
+	}
+}
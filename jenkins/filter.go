@@ -11,25 +11,34 @@ import (
 
 const JenkinsMagicURL = "/api/json"
 
-type FilterStep struct{}
+// FilterStep probes the hosts selected by Matcher for Jenkins instances.
+type FilterStep struct {
+	Matcher *scanct.CandidateMatcher
+}
 
-func (g FilterStep) SetProcessed(db *scanct.Database, i *scanct.Instance) error {
-	return db.SetInstanceProcessed(i)
+func (g FilterStep) SetProcessed(db *scanct.Database, c *scanct.Candidate) error {
+	return db.SetHostProcessedForJenkins(&c.Host)
 }
 
-func (g FilterStep) UnprocessedInputs(db *scanct.Database) ([]scanct.Instance, error) {
-	return db.GetUnprocessedInstancesForJenkins()
+func (g FilterStep) UnprocessedInputs(db *scanct.Database) ([]scanct.Candidate, error) {
+	return db.GetUnprocessedHostsForJenkins(g.Matcher)
 }
 
-func (g FilterStep) Process(instance *scanct.Instance) ([]scanct.Jenkins, error) {
+func (g FilterStep) Process(candidate *scanct.Candidate) ([]scanct.Jenkins, error) {
+	host := &candidate.Host
 	client := http.Client{
-		Timeout: 5 * time.Second,
+		Timeout:   5 * time.Second,
+		Transport: scanct.Transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 	}
-	resp, err := client.Get(fmt.Sprintf("https://%s%s", instance.Name, JenkinsMagicURL))
-	if err != nil {
+	resp, err := client.Get(fmt.Sprintf("https://%s%s", host.Name, JenkinsMagicURL))
+	var blocked *scanct.BlockedError
+	if errors.As(err, &blocked) {
+		// the transport logged the blocked connection already
+		return nil, nil
+	} else if err != nil {
 		return nil, errors.Wrap(err, "error requesting instance")
 	} else if resp.StatusCode != 200 {
 		return nil, errors.New(fmt.Sprintf("no instance found: status %d", resp.StatusCode))
@@ -37,7 +46,7 @@ func (g FilterStep) Process(instance *scanct.Instance) ([]scanct.Jenkins, error)
 		scriptAccess := false
 
 		var resp2 *http.Response
-		resp2, err = client.Get(fmt.Sprintf("https://%s/script", instance.Name))
+		resp2, err = client.Get(fmt.Sprintf("https://%s/script", host.Name))
 		if err == nil && resp2.StatusCode == 200 {
 			scriptAccess = true
 		}
@@ -49,9 +58,10 @@ func (g FilterStep) Process(instance *scanct.Instance) ([]scanct.Jenkins, error)
 		}
 		if resp.Header.Get("x-jenkins") != "" {
 			return []scanct.Jenkins{{
-				InstanceID:   instance.ID,
+				HostID:       host.ID,
+				Reason:       candidate.Reason,
 				AnonymousAPI: len(string(body)) > 2,
-				BaseURL:      fmt.Sprintf("https://%s", instance.Name),
+				BaseURL:      fmt.Sprintf("https://%s", host.Name),
 				ScriptAccess: scriptAccess,
 			}}, nil
 		}
@@ -63,6 +73,21 @@ func (g FilterStep) SaveResult(db *scanct.Database, result []scanct.Jenkins) err
 	return db.AddJenkins(result)
 }
 
-func FilterInstances() {
-	scanct.RunProcessStep[scanct.Instance, scanct.Jenkins](FilterStep{}, 5)
+// IsCandidate returns host as a candidate if it is live, unprocessed and matched by matcher, like
+// Database.GetUnprocessedHostsForJenkins.
+func IsCandidate(matcher *scanct.CandidateMatcher, host *scanct.Host) (scanct.Candidate, bool) {
+	if host.JenkinsProcessed || !host.Live() {
+		return scanct.Candidate{}, false
+	}
+	reason, ok := matcher.Match(host)
+	return scanct.Candidate{Host: *host, Reason: reason}, ok
+}
+
+func FilterInstances(matcher *scanct.CandidateMatcher) {
+	scanct.RunProcessStep[scanct.Candidate, scanct.Jenkins](FilterStep{Matcher: matcher}, 5)
+}
+
+// FilterStream probes the candidates received from candidates until the channel is closed.
+func FilterStream(candidates <-chan scanct.Candidate) {
+	scanct.RunProcessStepFrom[scanct.Candidate, scanct.Jenkins](FilterStep{}, 5, candidates)
 }
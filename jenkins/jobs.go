@@ -28,7 +28,8 @@ func (j JobStep) UnprocessedInputs(db *scanct.Database) ([]scanct.Jenkins, error
 func (j JobStep) Process(jenkins *scanct.Jenkins) ([]scanct.JenkinsJob, error) {
 	log.Info().Str("jenkins", jenkins.BaseURL).Msg("processing jenkins")
 	httpClient := http.Client{
-		Timeout: 5 * time.Second,
+		Timeout:   5 * time.Second,
+		Transport: scanct.Transport,
 	}
 	resp, err := httpClient.Get(fmt.Sprintf("%s/api/json", jenkins.BaseURL))
 	if err != nil {
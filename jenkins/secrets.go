@@ -21,7 +21,8 @@ func (f SecretsStep) UnprocessedInputs(db *scanct.Database) ([]scanct.JenkinsJob
 func (_ SecretsStep) Process(job *scanct.JenkinsJob) ([]scanct.JenkinsFinding, error) {
 	log.Info().Str("job", job.URL).Msg("processing job")
 	httpClient := http.Client{
-		Timeout: 30 * time.Second,
+		Timeout:   30 * time.Second,
+		Transport: scanct.Transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
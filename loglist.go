@@ -0,0 +1,162 @@
+package scanct
+
+import (
+	"encoding/json"
+	"github.com/google/certificate-transparency-go/loglist3"
+	"github.com/pkg/errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// LogListConfig selects the logs to fetch from a local copy of the v3 log_list.json, as published at
+// https://www.gstatic.com/ct/log_list/v3/log_list.json.
+type LogListConfig struct {
+	Path string `json:"path"`
+	// States lists the accepted log states, e.g. "usable", "qualified" or "readonly".
+	States []string `json:"states"`
+	// Operators restricts the logs to these operator names. An empty list accepts all operators.
+	Operators []string `json:"operators"`
+}
+
+func LoadLogList(path string) (*loglist3.LogList, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read log list")
+	}
+	logList, err := loglist3.NewFromJSON(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse log list")
+	}
+	return logList, nil
+}
+
+// TiledLog is a static CT API log from the tiled_logs of a log list, which loglist3 does not know about.
+type TiledLog struct {
+	Description      string                     `json:"description"`
+	Key              []byte                     `json:"key"`
+	SubmissionURL    string                     `json:"submission_url"`
+	MonitoringURL    string                     `json:"monitoring_url"`
+	MMD              int32                      `json:"mmd"`
+	State            *loglist3.LogStates        `json:"state"`
+	TemporalInterval *loglist3.TemporalInterval `json:"temporal_interval"`
+}
+
+// TiledOperator holds the tiled logs of the operator with the same name in a log list.
+type TiledOperator struct {
+	Name      string     `json:"name"`
+	TiledLogs []TiledLog `json:"tiled_logs"`
+}
+
+func LoadTiledLogs(path string) ([]TiledOperator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read log list")
+	}
+	var logList struct {
+		Operators []TiledOperator `json:"operators"`
+	}
+	err = json.Unmarshal(data, &logList)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse tiled logs")
+	}
+	return logList.Operators, nil
+}
+
+var logStates = map[string]loglist3.LogStatus{
+	"pending":   loglist3.PendingLogStatus,
+	"qualified": loglist3.QualifiedLogStatus,
+	"usable":    loglist3.UsableLogStatus,
+	"readonly":  loglist3.ReadOnlyLogStatus,
+	"retired":   loglist3.RetiredLogStatus,
+	"rejected":  loglist3.RejectedLogStatus,
+}
+
+func hasState(states []string, status loglist3.LogStatus) bool {
+	for _, state := range states {
+		if s, ok := logStates[strings.ToLower(state)]; ok && s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// SelectLogs returns the logs of logList that are in one of the configured states and belong to one of the
+// configured operators. Temporal shards are only selected while they can still hold unexpired certificates.
+func SelectLogs(logList *loglist3.LogList, config LogListConfig, now time.Time) []CTLogConfig {
+	var logs []CTLogConfig
+	for _, operator := range logList.Operators {
+		if len(config.Operators) > 0 && !containsFold(config.Operators, operator.Name) {
+			continue
+		}
+		for _, l := range operator.Logs {
+			if !hasState(config.States, l.State.LogStatus()) {
+				continue
+			}
+			if l.TemporalInterval != nil && !now.Before(l.TemporalInterval.EndExclusive) {
+				continue
+			}
+			logs = append(logs, CTLogConfig{
+				URL:         l.URL,
+				Description: l.Description,
+				Operator:    operator.Name,
+				PublicKey:   l.Key,
+				MMD:         time.Duration(l.MMD) * time.Second,
+			})
+		}
+	}
+	return logs
+}
+
+// SelectTiledLogs is SelectLogs for the static CT API logs of a log list.
+func SelectTiledLogs(operators []TiledOperator, config LogListConfig, now time.Time) []CTLogConfig {
+	var logs []CTLogConfig
+	for _, operator := range operators {
+		if len(config.Operators) > 0 && !containsFold(config.Operators, operator.Name) {
+			continue
+		}
+		for _, l := range operator.TiledLogs {
+			if !hasState(config.States, l.State.LogStatus()) {
+				continue
+			}
+			if l.TemporalInterval != nil && !now.Before(l.TemporalInterval.EndExclusive) {
+				continue
+			}
+			logs = append(logs, CTLogConfig{
+				URL:           l.SubmissionURL,
+				MonitoringURL: l.MonitoringURL,
+				Description:   l.Description,
+				Operator:      operator.Name,
+				PublicKey:     l.Key,
+				MMD:           time.Duration(l.MMD) * time.Second,
+			})
+		}
+	}
+	return logs
+}
+
+func LogsFromLogList(config LogListConfig) ([]CTLogConfig, error) {
+	logList, err := LoadLogList(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	tiledLogs, err := LoadTiledLogs(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	logs := SelectLogs(logList, config, time.Now())
+	logs = append(logs, SelectTiledLogs(tiledLogs, config, time.Now())...)
+	if len(logs) == 0 {
+		return nil, errors.New("no logs selected from log list")
+	}
+	return logs, nil
+}
@@ -0,0 +1,154 @@
+package scanct
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func selectedURLs(logs []CTLogConfig) []string {
+	var urls []string
+	for _, l := range logs {
+		urls = append(urls, l.URL)
+	}
+	return urls
+}
+
+func TestSelectLogs(t *testing.T) {
+	logList, err := LoadLogList("testdata/log_list.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		config LogListConfig
+		now    time.Time
+		want   []string
+	}{
+		{
+			name:   "usable",
+			config: LogListConfig{States: []string{"usable"}},
+			now:    now,
+			want:   []string{"https://ct.googleapis.com/logs/us1/argon2025h2/"},
+		},
+		{
+			name:   "states are case insensitive",
+			config: LogListConfig{States: []string{"Usable", "QUALIFIED"}},
+			now:    now,
+			want:   []string{"https://ct.googleapis.com/logs/us1/argon2025h2/", "https://oak.ct.letsencrypt.org/2025h2/"},
+		},
+		{
+			name:   "shard still accepting certificates",
+			config: LogListConfig{States: []string{"usable"}},
+			now:    time.Date(2025, 6, 30, 23, 59, 59, 0, time.UTC),
+			want:   []string{"https://ct.googleapis.com/logs/us1/argon2025h1/", "https://ct.googleapis.com/logs/us1/argon2025h2/"},
+		},
+		{
+			name:   "shard end is exclusive",
+			config: LogListConfig{States: []string{"usable"}},
+			now:    time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+			want:   nil,
+		},
+		{
+			name:   "expired shards are skipped in any state",
+			config: LogListConfig{States: []string{"readonly", "retired"}},
+			now:    now,
+			want:   []string{"https://ct.googleapis.com/logs/xenon/"},
+		},
+		{
+			name:   "operator filter",
+			config: LogListConfig{States: []string{"usable", "qualified"}, Operators: []string{"let's encrypt"}},
+			now:    now,
+			want:   []string{"https://oak.ct.letsencrypt.org/2025h2/"},
+		},
+		{
+			name:   "unknown operator",
+			config: LogListConfig{States: []string{"usable"}, Operators: []string{"Cloudflare"}},
+			now:    now,
+			want:   nil,
+		},
+		{
+			// Solera has no state and is never selected
+			name:   "all states",
+			config: LogListConfig{States: []string{"pending", "qualified", "usable", "readonly", "retired", "rejected"}},
+			now:    now,
+			want:   []string{"https://ct.googleapis.com/logs/us1/argon2025h2/", "https://ct.googleapis.com/logs/xenon/", "https://oak.ct.letsencrypt.org/2025h2/"},
+		},
+		{
+			name:   "no states",
+			config: LogListConfig{},
+			now:    now,
+			want:   nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := selectedURLs(SelectLogs(logList, test.config, test.now))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectTiledLogs(t *testing.T) {
+	operators, err := LoadTiledLogs("testdata/log_list.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 8, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		config LogListConfig
+		now    time.Time
+		want   []string
+	}{
+		{
+			name:   "usable",
+			config: LogListConfig{States: []string{"usable"}},
+			now:    now,
+			want:   []string{"https://log.sycamore.ct.letsencrypt.org/2025h2/"},
+		},
+		{
+			name:   "shard still accepting certificates",
+			config: LogListConfig{States: []string{"usable"}},
+			now:    time.Date(2025, 7, 19, 0, 0, 0, 0, time.UTC),
+			want:   []string{"https://log.sycamore.ct.letsencrypt.org/2025h2/", "https://log.sycamore.ct.letsencrypt.org/2025h1/"},
+		},
+		{
+			name:   "operator filter",
+			config: LogListConfig{States: []string{"usable"}, Operators: []string{"Google"}},
+			now:    now,
+			want:   nil,
+		},
+		{
+			// Willow2025h2 has no state and is never selected
+			name:   "all states",
+			config: LogListConfig{States: []string{"pending", "qualified", "usable", "readonly", "retired", "rejected"}},
+			now:    now,
+			want:   []string{"https://log.sycamore.ct.letsencrypt.org/2025h2/"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := selectedURLs(SelectTiledLogs(operators, test.config, test.now))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	logs := SelectTiledLogs(operators, LogListConfig{States: []string{"usable"}}, now)
+	want := CTLogConfig{
+		URL:           "https://log.sycamore.ct.letsencrypt.org/2025h2/",
+		MonitoringURL: "https://mon.sycamore.ct.letsencrypt.org/2025h2/",
+		Description:   "Let's Encrypt 'Sycamore2025h2'",
+		Operator:      "Let's Encrypt",
+		PublicKey:     []byte("sycamore2025h2"),
+		MMD:           time.Minute,
+	}
+	if len(logs) != 1 || !reflect.DeepEqual(logs[0], want) {
+		t.Errorf("got %+v, want %+v", logs, want)
+	}
+}
@@ -0,0 +1,762 @@
+package scanct
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SchemaMigration is a migration that has been applied to the database.
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// migration changes the schema from version Version-1 to Version. Released migrations must not change anymore, as
+// they have been applied to existing databases already. Schema changes are appended as new migrations instead.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+var migrations = []migration{
+	{Version: 1, Name: "initial schema", Up: createInitialSchema},
+	{Version: 2, Name: "backfill hosts", Up: backfillHosts},
+	{Version: 3, Name: "backfill host labels", Up: backfillHostLabels},
+	{Version: 4, Name: "bytewise host names", Up: setupPostgres},
+	{Version: 5, Name: "creation time of instances and findings", Up: addCreatedAt},
+	{Version: 6, Name: "certstream source of certificates", Up: addCertificateSource},
+	{Version: 7, Name: "null foreign keys", Up: nullForeignKeys},
+	{Version: 8, Name: "normalize legacy host names", Up: normalizeLegacyHosts},
+	{Version: 9, Name: "encrypt plaintext credentials", Up: encryptPlaintextCredentials},
+	{Version: 10, Name: "creation times in UTC", Up: utcCreatedAt},
+}
+
+// SchemaVersion is the latest schema version known to this binary.
+var SchemaVersion = migrations[len(migrations)-1].Version
+
+// createInitialSchema creates the schema as it was when migrations were introduced. The models are copied, so that
+// later changes to them do not change this migration. On databases that were created with AutoMigrate before, only
+// missing tables, columns and indexes are added.
+func createInitialSchema(tx *gorm.DB) error {
+	type CTLog struct {
+		ID                int
+		URL               string `gorm:"uniqueIndex:ct_logs_url"`
+		MonitoringURL     string
+		PublicKey         []byte
+		BatchSize         int64
+		TreeSize          uint64
+		Timestamp         uint64
+		RootHash          []byte
+		Signature         []byte
+		VerificationError string
+	}
+	type CTRange struct {
+		ID         int
+		CTLogID    int `gorm:"index:index_ct_ranges_ct_log_id"`
+		StartIndex int64
+		EndIndex   int64
+	}
+	type CTBadEntry struct {
+		ID        int
+		CTLogID   int   `gorm:"uniqueIndex:ct_bad_entries_ct_log_index"`
+		CTLog     CTLog `gorm:"foreignKey:CTLogID"`
+		Index     int64 `gorm:"uniqueIndex:ct_bad_entries_ct_log_index"`
+		LeafInput []byte
+		ExtraData []byte
+		Error     string
+		Retries   int
+	}
+	type DumpOffset struct {
+		ID        int
+		CTLogID   int   `gorm:"uniqueIndex:dump_offsets_ct_log_id"`
+		CTLog     CTLog `gorm:"foreignKey:CTLogID"`
+		Offset    int64
+		NextIndex int64
+	}
+	type Certificate struct {
+		ID                   int
+		CTLogID              int    `gorm:"uniqueIndex:certificates_ct_log_index"`
+		CTLog                CTLog  `gorm:"foreignKey:CTLogID"`
+		Index                int64  `gorm:"uniqueIndex:certificates_ct_log_index"`
+		Issuer               string `gorm:"index:index_certificates_issuer"`
+		Serial               string
+		NotBefore            time.Time
+		NotAfter             time.Time
+		Timestamp            time.Time `gorm:"index:index_certificates_timestamp"`
+		Precert              bool
+		PublicKeyFingerprint string `gorm:"index:index_certificates_public_key_fingerprint"`
+		IPAddresses          string
+		EmailAddresses       string
+	}
+	type DroppedName struct {
+		ID    int
+		Rule  string `gorm:"uniqueIndex:dropped_names_rule"`
+		Count int64
+	}
+	type Host struct {
+		ID               int
+		Name             string `gorm:"uniqueIndex:hosts_name"`
+		Domain           string `gorm:"index:index_hosts_domain"`
+		Wildcard         bool
+		FirstSeen        int64
+		LastSeen         int64
+		CertificateCount int64
+		GitLabProcessed  bool
+		JenkinsProcessed bool
+		DNSProcessed     bool
+		DNSStatus        string
+	}
+	type HostLabel struct {
+		ID     int
+		Label  string `gorm:"uniqueIndex:host_labels_label_host_id"`
+		HostID int    `gorm:"uniqueIndex:host_labels_label_host_id"`
+	}
+	type DNSRecord struct {
+		ID     int
+		HostID int  `gorm:"index:index_dns_records_host_id"`
+		Host   Host `gorm:"foreignKey:HostID"`
+		Type   string
+		Value  string
+	}
+	type Instance struct {
+		ID            int
+		CTLogID       int         `gorm:"index:index_ct_log_id"`
+		CTLog         CTLog       `gorm:"foreignKey:CTLogID"`
+		CertificateID int         `gorm:"index:index_certificate_id"`
+		Certificate   Certificate `gorm:"foreignKey:CertificateID"`
+		HostID        int         `gorm:"index:index_host_id"`
+		Host          Host        `gorm:"foreignKey:HostID"`
+		Name          string      `gorm:"index:index_name"`
+		Wildcard      bool
+		Domain        string `gorm:"index:index_domain"`
+		Index         int64  `gorm:"index:index_index"`
+	}
+	type GitLab struct {
+		ID          int
+		HostID      int
+		Host        Host `gorm:"foreignKey:HostID"`
+		Reason      string
+		AllowSignup bool
+		Email       string
+		Password    string
+		APIToken    string
+		Processed   bool
+		BaseURL     string `gorm:"uniqueIndex:git_labs_base_url"`
+	}
+	type Jenkins struct {
+		ID           int
+		HostID       int
+		Host         Host `gorm:"foreignKey:HostID"`
+		Reason       string
+		AnonymousAPI bool
+		BaseURL      string `gorm:"uniqueIndex:jenkins_base_url"`
+		Processed    bool
+		ScriptAccess bool
+	}
+	type JenkinsJob struct {
+		ID        int
+		JenkinsID int
+		Jenkins   Jenkins `gorm:"foreignKey:JenkinsID"`
+		Name      string
+		URL       string `gorm:"uniqueIndex:jenkins_jobs_url"`
+		Processed bool
+	}
+	type Repository struct {
+		ID        int
+		GitLabID  int    `gorm:"uniqueIndex:repo"`
+		GitLab    GitLab `gorm:"foreignKey:GitLabID"`
+		Name      string `gorm:"uniqueIndex:repo"`
+		Processed bool
+	}
+	type Finding struct {
+		ID           int
+		RepositoryID int
+		Repository   Repository `gorm:"foreignKey:RepositoryID"`
+		Secret       string
+		Commit       string
+		StartLine    int
+		EndLine      int
+		File         string
+		URL          string
+		CommitDate   string
+		Rule         string
+		Processed    bool
+	}
+	type JenkinsFinding struct {
+		ID        int
+		JobID     int
+		Job       JenkinsJob `gorm:"foreignKey:JobID"`
+		Secret    string
+		StartLine int
+		EndLine   int
+		File      string
+		URL       string
+		Rule      string
+		Processed bool
+	}
+	type AWSKey struct {
+		ID               int
+		AccessKey        string `gorm:"uniqueIndex:accesskey"`
+		SecretKey        string
+		FindingID        int
+		Finding          Finding `gorm:"foreignKey:FindingID"`
+		JenkinsFindingID int
+		JenkinsFinding   JenkinsFinding `gorm:"foreignKey:JenkinsFindingID"`
+		Arn              string
+	}
+	type Run struct {
+		ID        int
+		StartedAt time.Time
+		Command   string
+		ScopeFile string
+		Scope     string
+	}
+	return tx.AutoMigrate(&CTLog{}, &CTRange{}, &CTBadEntry{}, &DumpOffset{}, &Certificate{}, &DroppedName{}, &Host{}, &HostLabel{}, &DNSRecord{}, &Instance{}, &GitLab{}, &Jenkins{}, &JenkinsJob{}, &Repository{}, &Finding{}, &JenkinsFinding{}, &AWSKey{}, &Run{})
+}
+
+// addCreatedAt records when instances and findings are found. Existing rows keep a null creation time.
+func addCreatedAt(tx *gorm.DB) error {
+	type GitLab struct {
+		CreatedAt time.Time
+	}
+	type Jenkins struct {
+		CreatedAt time.Time
+	}
+	type Finding struct {
+		CreatedAt time.Time
+	}
+	type JenkinsFinding struct {
+		CreatedAt time.Time
+	}
+	for _, model := range []interface{}{&GitLab{}, &Jenkins{}, &Finding{}, &JenkinsFinding{}} {
+		if tx.Migrator().HasColumn(model, "CreatedAt") {
+			continue
+		}
+		err := tx.Migrator().AddColumn(model, "CreatedAt")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addCertificateSource records the log and index that a certstream server claimed for a certificate.
+func addCertificateSource(tx *gorm.DB) error {
+	type Certificate struct {
+		SourceURL   string
+		SourceIndex *int64
+	}
+	for _, column := range []string{"SourceURL", "SourceIndex"} {
+		if tx.Migrator().HasColumn(&Certificate{}, column) {
+			continue
+		}
+		err := tx.Migrator().AddColumn(&Certificate{}, column)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nullForeignKeys replaces the zero IDs that were stored for missing references with null. Databases that enforce
+// foreign keys reject zero IDs, because there is no row with ID zero.
+func nullForeignKeys(tx *gorm.DB) error {
+	columns := []struct {
+		table  string
+		column string
+	}{
+		{"aws_keys", "finding_id"},
+		{"aws_keys", "jenkins_finding_id"},
+		{"instances", "ct_log_id"},
+		{"instances", "certificate_id"},
+		{"instances", "host_id"},
+		{"git_labs", "host_id"},
+		{"jenkins", "host_id"},
+	}
+	for _, c := range columns {
+		if !tx.Migrator().HasColumn(c.table, c.column) {
+			continue
+		}
+		err := tx.Table(c.table).Where(c.column+" = 0").Update(c.column, nil).Error
+		if err != nil {
+			return errors.Wrapf(err, "could not clear %s.%s", c.table, c.column)
+		}
+	}
+	return nil
+}
+
+// normalizeLegacyHosts normalizes the names of instances that were stored before hosts were added and links them,
+// and the GitLab and Jenkins instances found on them, to their hosts. The hosts that the backfill created from the
+// names as they appear in certificates are merged into the hosts of the normalized names. Names that are not valid
+// hostnames keep no host. Instances that were linked already, such as all of them in databases whose backfill
+// normalized names before, are left as they are.
+func normalizeLegacyHosts(tx *gorm.DB) error {
+	type Host struct {
+		ID               int
+		Name             string
+		Domain           string
+		Wildcard         bool
+		FirstSeen        int64
+		LastSeen         int64
+		CertificateCount int64
+		GitLabProcessed  bool
+		JenkinsProcessed bool
+	}
+	type Instance struct {
+		ID        int
+		Name      string
+		Index     int64
+		Processed bool
+	}
+	type HostLabel struct {
+		ID     int
+		Label  string
+		HostID int
+	}
+	if !tx.Migrator().HasColumn("instances", "processed") {
+		return nil
+	}
+
+	// hosts named as in certificates are merged into the host of their normalized name
+	raw := make(map[int]Host)
+	var hosts []Host
+	err := tx.FindInBatches(&hosts, 10000, func(batch *gorm.DB, _ int) error {
+		for _, host := range hosts {
+			hostname, err := normalizeLegacyHostname(host.Name)
+			if err != nil || hostname.Name != host.Name {
+				raw[host.ID] = host
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return errors.Wrap(err, "could not read hosts")
+	}
+
+	// the backfill counted the instances of a host that was named like their normalized name already, and new
+	// certificates are counted when they are stored, so only the other instances are added to the count
+	unlinked := func() *gorm.DB {
+		return tx.Model(&Instance{}).Where("host_id is null or host_id = 0")
+	}
+	byName := make(map[string]*Host)
+	var instances []Instance
+	err = unlinked().FindInBatches(&instances, 10000, func(batch *gorm.DB, _ int) error {
+		for _, instance := range instances {
+			hostname, err := normalizeLegacyHostname(instance.Name)
+			if err != nil {
+				continue
+			}
+			host, ok := byName[hostname.Name]
+			if !ok {
+				host = &Host{Name: hostname.Name, Domain: hostname.Domain, FirstSeen: instance.Index, LastSeen: instance.Index}
+				byName[hostname.Name] = host
+			}
+			host.Wildcard = host.Wildcard || hostname.Wildcard
+			if instance.Index < host.FirstSeen {
+				host.FirstSeen = instance.Index
+			}
+			if instance.Index > host.LastSeen {
+				host.LastSeen = instance.Index
+			}
+			if instance.Name != hostname.Name {
+				host.CertificateCount++
+			}
+			host.GitLabProcessed = host.GitLabProcessed || instance.Processed
+			host.JenkinsProcessed = host.JenkinsProcessed || instance.Processed
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return errors.Wrap(err, "could not read instances")
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hostIDs := make(map[string]int, len(names))
+	var labels []HostLabel
+	for _, name := range names {
+		host := byName[name]
+		var existing Host
+		err = tx.Where("name = ?", name).Limit(1).Find(&existing).Error
+		if err != nil {
+			return errors.Wrap(err, "could not get host")
+		}
+		if existing.ID == 0 {
+			err = tx.Create(host).Error
+		} else {
+			host.ID = existing.ID
+			host.Wildcard = host.Wildcard || existing.Wildcard
+			if existing.FirstSeen < host.FirstSeen {
+				host.FirstSeen = existing.FirstSeen
+			}
+			if existing.LastSeen > host.LastSeen {
+				host.LastSeen = existing.LastSeen
+			}
+			host.CertificateCount += existing.CertificateCount
+			host.GitLabProcessed = host.GitLabProcessed || existing.GitLabProcessed
+			host.JenkinsProcessed = host.JenkinsProcessed || existing.JenkinsProcessed
+			err = tx.Save(host).Error
+		}
+		if err != nil {
+			return errors.Wrap(err, "could not store host")
+		}
+		hostIDs[name] = host.ID
+		for _, label := range Unique(legacySubdomainLabels(host.Name, host.Domain)) {
+			labels = append(labels, HostLabel{Label: label, HostID: host.ID})
+		}
+	}
+	if len(labels) > 0 {
+		err = tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&labels, 1000).Error
+		if err != nil {
+			return errors.Wrap(err, "could not create host labels")
+		}
+	}
+
+	// every instance is read once, so instances that were updated already are never normalized again
+	err = unlinked().FindInBatches(&instances, 10000, func(batch *gorm.DB, _ int) error {
+		for _, instance := range instances {
+			hostname, err := normalizeLegacyHostname(instance.Name)
+			if err != nil {
+				continue
+			}
+			err = tx.Table("instances").Where("id = ?", instance.ID).Updates(map[string]interface{}{
+				"host_id":  hostIDs[hostname.Name],
+				"name":     hostname.Name,
+				"wildcard": hostname.Wildcard,
+				"domain":   hostname.Domain,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return errors.Wrap(err, "could not link instances")
+	}
+
+	rawIDs := make([]int, 0, len(raw))
+	for id := range raw {
+		rawIDs = append(rawIDs, id)
+	}
+	sort.Ints(rawIDs)
+	for _, id := range rawIDs {
+		host := raw[id]
+		var target Host
+		if hostname, err := normalizeLegacyHostname(host.Name); err == nil {
+			err = tx.Where("name = ?", hostname.Name).Limit(1).Find(&target).Error
+			if err != nil {
+				return errors.Wrap(err, "could not get host")
+			}
+		}
+		// references to hosts of invalid names are cleared
+		var targetID interface{}
+		if target.ID != 0 {
+			targetID = target.ID
+			processed := make(map[string]interface{})
+			if host.GitLabProcessed {
+				processed["git_lab_processed"] = true
+			}
+			if host.JenkinsProcessed {
+				processed["jenkins_processed"] = true
+			}
+			if len(processed) > 0 {
+				err = tx.Table("hosts").Where("id = ?", target.ID).Updates(processed).Error
+				if err != nil {
+					return errors.Wrap(err, "could not merge host")
+				}
+			}
+		}
+		for _, table := range []string{"instances", "git_labs", "jenkins"} {
+			err = tx.Table(table).Where("host_id = ?", id).Update("host_id", targetID).Error
+			if err != nil {
+				return errors.Wrapf(err, "could not relink %s", table)
+			}
+		}
+		for _, table := range []string{"dns_records", "host_labels"} {
+			err = tx.Exec("delete from "+table+" where host_id = ?", id).Error
+			if err != nil {
+				return errors.Wrapf(err, "could not delete %s", table)
+			}
+		}
+		err = tx.Exec("delete from hosts where id = ?", id).Error
+		if err != nil {
+			return errors.Wrap(err, "could not delete host")
+		}
+	}
+
+	for _, table := range []string{"git_labs", "jenkins"} {
+		if !tx.Migrator().HasColumn(table, "instance_id") {
+			continue
+		}
+		err = tx.Exec(`update ` + table + ` set host_id = (select host_id from instances where instances.id = ` + table + `.instance_id)
+			where host_id is null or host_id = 0`).Error
+		if err != nil {
+			return errors.Wrapf(err, "could not link %s", table)
+		}
+	}
+	return nil
+}
+
+// encryptPlaintextCredentials encrypts the credentials that were stored before encryption was added, so that no
+// plaintext is left to be read. It needs the encryption key unless there are none.
+func encryptPlaintextCredentials(tx *gorm.DB) error {
+	columns := []struct {
+		table  string
+		column string
+	}{
+		{"git_labs", "password"},
+		{"git_labs", "api_token"},
+		{"findings", "secret"},
+		{"jenkins_findings", "secret"},
+		{"aws_keys", "secret_key"},
+	}
+	for _, c := range columns {
+		type row struct {
+			ID    int
+			Value string
+		}
+		var rows []row
+		query := tx.Table(c.table).Select("id", c.column+" as value").Where(c.column+" <> '' and "+c.column+" not like ?", encryptedPrefix+"%")
+		err := query.FindInBatches(&rows, 1000, func(batch *gorm.DB, _ int) error {
+			for _, r := range rows {
+				// the value is sealed for the column like the encrypted serializer does
+				ciphertext, err := sealValue(r.Value, c.table+"."+c.column)
+				if err != nil {
+					return err
+				}
+				err = tx.Table(c.table).Where("id = ?", r.ID).Update(c.column, ciphertext).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+		if err != nil {
+			return errors.Wrapf(err, "could not encrypt %s.%s", c.table, c.column)
+		}
+	}
+	return nil
+}
+
+// utcCreatedAt converts the creation times that SQLite stored with the local offset to UTC, so that they compare
+// correctly with the times of -since and -until. Postgres stores times without their offset.
+func utcCreatedAt(tx *gorm.DB) error {
+	if tx.Dialector.Name() != "sqlite" {
+		return nil
+	}
+	for _, table := range []string{"git_labs", "jenkins", "findings", "jenkins_findings"} {
+		type row struct {
+			ID        int
+			CreatedAt time.Time
+		}
+		var rows []row
+		query := tx.Table(table).Select("id", "created_at").Where("created_at is not null")
+		err := query.FindInBatches(&rows, 1000, func(batch *gorm.DB, _ int) error {
+			for _, r := range rows {
+				err := tx.Table(table).Where("id = ?", r.ID).UpdateColumn("created_at", r.CreatedAt.UTC()).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+		if err != nil {
+			return errors.Wrapf(err, "could not convert creation times of %s", table)
+		}
+	}
+	return nil
+}
+
+// legacyHostname is a Hostname as normalizeLegacyHostname returns it.
+type legacyHostname struct {
+	Name     string
+	Wildcard bool
+	Domain   string
+}
+
+var legacyHostnameProfile = idna.New(idna.MapForLookup(), idna.Transitional(false), idna.StrictDomainName(false))
+
+// normalizeLegacyHostname is NormalizeHostname as it was when normalizeLegacyHosts was added, so that later changes
+// to the normalization do not change the migration.
+func normalizeLegacyHostname(subject string) (legacyHostname, error) {
+	name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(subject)), ".")
+	if name == "" {
+		return legacyHostname{}, errors.New("empty name")
+	}
+	if net.ParseIP(name) != nil {
+		return legacyHostname{}, errors.New("ip address")
+	}
+	hostname := legacyHostname{}
+	if strings.HasPrefix(name, "*.") {
+		hostname.Wildcard = true
+		name = name[2:]
+	}
+	name, err := legacyHostnameProfile.ToASCII(name)
+	if err != nil {
+		return legacyHostname{}, errors.Wrap(err, "invalid idn")
+	}
+	if len(name) > 253 {
+		return legacyHostname{}, errors.New("name too long")
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return legacyHostname{}, errors.New("not a fully qualified name")
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return legacyHostname{}, errors.Errorf("invalid label %q", label)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return legacyHostname{}, errors.Errorf("invalid label %q", label)
+			}
+		}
+	}
+	hostname.Name = name
+	hostname.Domain, err = publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return legacyHostname{}, errors.Wrap(err, "no registrable domain")
+	}
+	return hostname, nil
+}
+
+// legacySubdomainLabels is subdomainLabels as it was when normalizeLegacyHosts was added.
+func legacySubdomainLabels(name string, domain string) []string {
+	if domain == "" || name == domain || !strings.HasSuffix(name, "."+domain) {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(name, "."+domain), ".")
+}
+
+// schemaVersion returns the highest applied migration, or zero if none has been applied.
+func schemaVersion(db *gorm.DB) (int, error) {
+	var version *int
+	err := db.Model(&SchemaMigration{}).Select("max(version)").Scan(&version).Error
+	if err != nil || version == nil {
+		return 0, err
+	}
+	return *version, nil
+}
+
+// isEmpty reports whether db has no tables but schema_migrations, which is created when the database is opened.
+func isEmpty(db *gorm.DB) (bool, error) {
+	tables, err := db.Migrator().GetTables()
+	if err != nil {
+		return false, err
+	}
+	for _, table := range tables {
+		if table != "schema_migrations" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// checkSchema returns an error unless db is at SchemaVersion. A database without any tables is migrated, so that
+// new databases work without running migrations first.
+func checkSchema(db *gorm.DB) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return errors.Wrap(err, "could not get schema version")
+	}
+	if version > SchemaVersion {
+		return errors.Errorf("database schema version %d is newer than version %d of this binary", version, SchemaVersion)
+	}
+	if version == 0 {
+		empty, err := isEmpty(db)
+		if err != nil {
+			return errors.Wrap(err, "could not list tables")
+		}
+		if empty {
+			return migrate(db)
+		}
+	}
+	if version < SchemaVersion {
+		return errors.Errorf("database schema version %d is older than version %d, run 'scanct db migrate'", version, SchemaVersion)
+	}
+	return nil
+}
+
+// migrate applies all pending migrations, each in its own transaction.
+func migrate(db *gorm.DB) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return errors.Wrap(err, "could not get schema version")
+	}
+	if version > SchemaVersion {
+		return errors.Errorf("database schema version %d is newer than version %d of this binary", version, SchemaVersion)
+	}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		log.Info().Int("version", m.Version).Str("name", m.Name).Msg("applying migration")
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := m.Up(tx)
+			if err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now().UTC()}).Error
+		})
+		if err != nil {
+			return errors.Wrapf(err, "could not apply migration %d", m.Version)
+		}
+	}
+	return nil
+}
+
+// MigrateDatabase applies all pending migrations.
+func MigrateDatabase() {
+	db, err := openDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	err = migrate(db.db)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not migrate database")
+	}
+	log.Info().Int("version", SchemaVersion).Msg("database is up to date")
+}
+
+// ListMigrations logs the applied and pending migrations.
+func ListMigrations() {
+	db, err := openDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	var applied []SchemaMigration
+	err = db.db.Order("version").Find(&applied).Error
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not get applied migrations")
+	}
+	appliedAt := make(map[int]time.Time)
+	for _, m := range applied {
+		appliedAt[m.Version] = m.AppliedAt
+		if m.Version > SchemaVersion {
+			log.Warn().Int("version", m.Version).Str("name", m.Name).Time("applied_at", m.AppliedAt).Msg("unknown migration")
+		}
+	}
+	for _, m := range migrations {
+		if t, ok := appliedAt[m.Version]; ok {
+			log.Info().Int("version", m.Version).Str("name", m.Name).Time("applied_at", t).Msg("applied migration")
+		} else {
+			log.Info().Int("version", m.Version).Str("name", m.Name).Msg("pending migration")
+		}
+	}
+}
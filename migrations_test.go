@@ -0,0 +1,111 @@
+package scanct
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSchemaMigratesOnlyEmptyDatabases(t *testing.T) {
+	db := testDatabase(t)
+	err := checkSchema(db.db)
+	if err != nil {
+		t.Fatalf("empty database: %v", err)
+	}
+	version, err := schemaVersion(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion {
+		t.Fatalf("empty database was migrated to version %d, want %d", version, SchemaVersion)
+	}
+
+	// a database from before migrations has tables, but no ct_logs
+	db = testLegacyDatabase(t)
+	createLegacyInstances(t, &db)
+	err = checkSchema(db.db)
+	if err == nil || !strings.Contains(err.Error(), "scanct db migrate") {
+		t.Fatalf("legacy database: got %v, want an error asking to migrate", err)
+	}
+	version, err = schemaVersion(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 || db.db.Migrator().HasTable("hosts") {
+		t.Fatalf("legacy database was migrated to version %d", version)
+	}
+}
+
+func TestNullForeignKeys(t *testing.T) {
+	db := testLegacyDatabase(t)
+	err := migrate(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// zero IDs as stored by earlier versions, which SQLite accepts without enforcing foreign keys
+	err = db.db.Exec("insert into aws_keys (access_key, secret_key, finding_id, jenkins_finding_id) values ('AKIA0', '', 0, 0)").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nullForeignKeys(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key AWSKey
+	err = db.db.Select("finding_id", "jenkins_finding_id").First(&key).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.FindingID != nil || key.JenkinsFindingID != nil {
+		t.Errorf("finding IDs are %v and %v, want null", key.FindingID, key.JenkinsFindingID)
+	}
+}
+
+func TestEncryptPlaintextCredentials(t *testing.T) {
+	db := testDatabase(t)
+	err := migrate(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// secrets stored in plaintext by earlier versions, and an empty one that stays as it is
+	err = db.db.Exec("insert into aws_keys (access_key, secret_key) values ('AKIA0', 'secret'), ('AKIA1', '')").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []AWSKey
+	err = db.db.Order("id").Find(&keys).Error
+	if err == nil || !strings.Contains(err.Error(), "not encrypted") {
+		t.Fatalf("reading plaintext: got %v, want an error", err)
+	}
+
+	previousKey := currentKey
+	currentKey = nil
+	err = encryptPlaintextCredentials(db.db)
+	currentKey = previousKey
+	if err == nil || !strings.Contains(err.Error(), KeyEnv) {
+		t.Fatalf("migrating without key: got %v, want an error asking for the key", err)
+	}
+
+	err = SetEncryptionKey(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = encryptPlaintextCredentials(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []string
+	err = db.db.Table("aws_keys").Order("id").Pluck("secret_key", &stored).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored[0], encryptedPrefix) || stored[1] != "" {
+		t.Errorf("stored secret keys are %q, want the first one encrypted and the second one empty", stored)
+	}
+	err = db.db.Order("id").Find(&keys).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys[0].SecretKey != "secret" || keys[1].SecretKey != "" {
+		t.Errorf("secret keys are %q and %q, want secret and an empty one", keys[0].SecretKey, keys[1].SecretKey)
+	}
+}
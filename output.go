@@ -0,0 +1,105 @@
+package scanct
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+	FormatCSV   = "csv"
+)
+
+// RedactSecret keeps the first four characters of secret, which usually tell its type, and masks the rest.
+func RedactSecret(secret string) string {
+	runes := []rune(secret)
+	if len(runes) <= 4 {
+		return strings.Repeat("*", len(runes))
+	}
+	return string(runes[:4]) + strings.Repeat("*", len(runes)-4)
+}
+
+type row interface {
+	fields() []string
+}
+
+// writeRows writes rows as an aligned table, a JSON array or CSV with a header.
+func writeRows[R row](w io.Writer, format string, columns []string, rows []R) error {
+	switch format {
+	case FormatTable:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(columns, "\t")))
+		for _, r := range rows {
+			fmt.Fprintln(tw, strings.Join(r.fields(), "\t"))
+		}
+		return tw.Flush()
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		err := cw.Write(columns)
+		if err != nil {
+			return err
+		}
+		for _, r := range rows {
+			err = cw.Write(r.fields())
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return errors.Errorf("unknown format %q", format)
+	}
+}
+
+// ListFindings writes the findings selected by filter to stdout in format. Secrets are redacted unless showSecrets
+// is set.
+func ListFindings(filter *ResultFilter, format string, showSecrets bool) {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	rows, err := db.QueryFindings(filter)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not get findings")
+	}
+	if !showSecrets {
+		for i := range rows {
+			rows[i].Secret = RedactSecret(rows[i].Secret)
+		}
+	}
+	err = writeRows(os.Stdout, format, findingColumns, rows)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not write findings")
+	}
+}
+
+// ListInstances writes the instances selected by filter to stdout in format.
+func ListInstances(filter *ResultFilter, format string) {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	rows, err := db.QueryInstances(filter)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not get instances")
+	}
+	err = writeRows(os.Stdout, format, instanceColumns, rows)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not write instances")
+	}
+}
@@ -1,6 +1,7 @@
 package scanct
 
 import (
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"math/rand"
 )
@@ -44,6 +45,11 @@ func FilterProcessWorker[I, O any](filter ProcessStep[I, O], instanceChan <-chan
 		if !ok {
 			return
 		}
+		if target, ok := any(instance).(Target); ok && !scope.AllowsHost(target.TargetHost()) {
+			// out-of-scope inputs stay unprocessed, so they are picked up if the scope is widened
+			log.Warn().Str("target", target.TargetHost()).Msg("refusing out-of-scope target")
+			continue
+		}
 		result, err := filter.Process(&instance)
 		resultChan <- ProcessResult[I, O]{
 			Input:  instance,
@@ -53,30 +59,26 @@ func FilterProcessWorker[I, O any](filter ProcessStep[I, O], instanceChan <-chan
 	}
 }
 
+// FilterOutputWorker stores the results and processed flags through the shared writer, which commits them in
+// batches. It returns once they are committed.
 func FilterOutputWorker[I, O any](filter ProcessStep[I, O], resultsChan <-chan ProcessResult[I, O]) {
-	db, err := NewDatabase()
-	if err != nil {
-		log.Fatal().Err(err).Msg("could not create database")
-	}
-	for {
-		result, ok := <-resultsChan
-		if !ok {
-			return
-		}
-		if result.Error == nil && len(result.Output) > 0 {
-			err = filter.SaveResult(&db, result.Output)
-			if err != nil {
-				log.Fatal().Err(err).Msg("could not save result")
-			}
-		} else if result.Error != nil {
+	writer := SharedWriter()
+	defer writer.Flush()
+	for result := range resultsChan {
+		if result.Error != nil {
 			log.Error().Err(result.Error).Msg("could not process instance")
 		}
-		err = filter.SetProcessed(&db, &result.Input)
-		if err != nil {
-			log.Fatal().Err(err).Msg("could not set instance processed")
-		}
+		result := result
+		writer.Write(func(db *Database) error {
+			if result.Error == nil && len(result.Output) > 0 {
+				err := filter.SaveResult(db, result.Output)
+				if err != nil {
+					return errors.Wrap(err, "could not save result")
+				}
+			}
+			return errors.Wrap(filter.SetProcessed(db, &result.Input), "could not set instance processed")
+		})
 	}
-
 }
 
 func RunProcessStep[I, O any](step ProcessStep[I, O], workers int) {
@@ -95,3 +97,25 @@ func RunProcessStep[I, O any](step ProcessStep[I, O], workers int) {
 		OutputBuffer: 100,
 	}.Run()
 }
+
+// RunProcessStepFrom runs step on the inputs received from inputChan instead of the unprocessed inputs stored in
+// the database. It returns once inputChan is closed and all inputs are processed.
+func RunProcessStepFrom[I, O any](step ProcessStep[I, O], workers int, inputChan <-chan I) {
+	Fan[I, ProcessResult[I, O]]{
+		InputWorker: func(instanceChan chan<- I) {
+			for input := range inputChan {
+				instanceChan <- input
+			}
+			close(instanceChan)
+		},
+		ProcessWorker: func(instanceChan <-chan I, resultChan chan<- ProcessResult[I, O]) {
+			FilterProcessWorker(step, instanceChan, resultChan)
+		},
+		OutputWorker: func(resultsChan <-chan ProcessResult[I, O]) {
+			FilterOutputWorker(step, resultsChan)
+		},
+		Workers:      workers,
+		InputBuffer:  100,
+		OutputBuffer: 100,
+	}.Run()
+}
@@ -0,0 +1,206 @@
+package scanct
+
+import (
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ServiceGitLab  = "gitlab"
+	ServiceJenkins = "jenkins"
+)
+
+// ResultFilter selects findings and instances. Empty fields match everything. Host matches the host and the names
+// below it, and Since and Until compare with the time a result was found. Validated findings have an AWS key that
+// STS accepted, validated GitLab instances let us register an account and validated Jenkins instances have an
+// anonymous API.
+type ResultFilter struct {
+	Service   string
+	Rule      string
+	Host      string
+	Since     time.Time
+	Until     time.Time
+	Processed *bool
+	Validated bool
+}
+
+func (f *ResultFilter) includes(service string) bool {
+	return f.Service == "" || f.Service == service
+}
+
+func (f *ResultFilter) apply(query *gorm.DB, table string) *gorm.DB {
+	if !f.Since.IsZero() {
+		query = query.Where(table+".created_at >= ?", f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		query = query.Where(table+".created_at < ?", f.Until.UTC())
+	}
+	if f.Processed != nil {
+		query = query.Where(table+".processed = ?", *f.Processed)
+	}
+	return query
+}
+
+func (f *ResultFilter) matchesHost(host string) bool {
+	return f.Host == "" || inDomain(strings.ToLower(host), normalizeSuffix(f.Host))
+}
+
+// FindingRow is a GitLab or Jenkins finding as it is listed.
+type FindingRow struct {
+	Service   string    `json:"service"`
+	ID        int       `json:"id"`
+	Host      string    `json:"host"`
+	Rule      string    `json:"rule"`
+	Secret    string    `json:"secret"`
+	File      string    `json:"file"`
+	StartLine int       `json:"start_line"`
+	URL       string    `json:"url"`
+	FoundAt   time.Time `json:"found_at"`
+	Processed bool      `json:"processed"`
+	Validated bool      `json:"validated"`
+	Arn       string    `json:"arn,omitempty"`
+}
+
+var findingColumns = []string{"service", "id", "host", "rule", "secret", "file", "start_line", "url", "found_at", "processed", "validated", "arn"}
+
+func (r FindingRow) fields() []string {
+	return []string{r.Service, strconv.Itoa(r.ID), r.Host, r.Rule, r.Secret, r.File, strconv.Itoa(r.StartLine), r.URL,
+		formatTime(r.FoundAt), strconv.FormatBool(r.Processed), strconv.FormatBool(r.Validated), r.Arn}
+}
+
+// InstanceRow is a GitLab or Jenkins instance as it is listed.
+type InstanceRow struct {
+	Service   string    `json:"service"`
+	ID        int       `json:"id"`
+	Host      string    `json:"host"`
+	BaseURL   string    `json:"base_url"`
+	Reason    string    `json:"reason"`
+	FoundAt   time.Time `json:"found_at"`
+	Processed bool      `json:"processed"`
+	Validated bool      `json:"validated"`
+}
+
+var instanceColumns = []string{"service", "id", "host", "base_url", "reason", "found_at", "processed", "validated"}
+
+func (r InstanceRow) fields() []string {
+	return []string{r.Service, strconv.Itoa(r.ID), r.Host, r.BaseURL, r.Reason, formatTime(r.FoundAt),
+		strconv.FormatBool(r.Processed), strconv.FormatBool(r.Validated)}
+}
+
+// formatTime leaves the time of results found before it was recorded empty.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// validatedKeys returns the ARN of every AWS key that STS accepted by access key. A key is stored only once, so
+// findings of the same key are looked up by their secret instead of by ID.
+func (d *Database) validatedKeys() (map[string]string, error) {
+	var keys []AWSKey
+	err := d.db.Select("access_key", "arn").Find(&keys).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get aws keys")
+	}
+	arns := make(map[string]string)
+	for _, key := range keys {
+		arns[key.AccessKey] = key.Arn
+	}
+	return arns, nil
+}
+
+// QueryFindings returns the findings selected by filter, ordered by service and ID.
+func (d *Database) QueryFindings(filter *ResultFilter) ([]FindingRow, error) {
+	arns, err := d.validatedKeys()
+	if err != nil {
+		return nil, err
+	}
+	rows := []FindingRow{}
+	add := func(row FindingRow) {
+		row.Arn, row.Validated = arns[row.Secret]
+		if filter.matchesHost(row.Host) && (!filter.Validated || row.Validated) {
+			rows = append(rows, row)
+		}
+	}
+	if filter.includes(ServiceGitLab) {
+		var findings []Finding
+		query := filter.apply(d.db.Model(&Finding{}), "findings")
+		if filter.Rule != "" {
+			query = query.Where("rule = ?", filter.Rule)
+		}
+		err = query.Preload("Repository.GitLab").Order("id").Find(&findings).Error
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get findings")
+		}
+		for _, f := range findings {
+			add(FindingRow{Service: ServiceGitLab, ID: f.ID, Host: f.TargetHost(), Rule: f.Rule, Secret: f.Secret,
+				File: f.File, StartLine: f.StartLine, URL: f.URL, FoundAt: f.CreatedAt, Processed: f.Processed})
+		}
+	}
+	if filter.includes(ServiceJenkins) {
+		var findings []JenkinsFinding
+		query := filter.apply(d.db.Model(&JenkinsFinding{}), "jenkins_findings")
+		if filter.Rule != "" {
+			query = query.Where("rule = ?", filter.Rule)
+		}
+		err = query.Preload("Job").Order("id").Find(&findings).Error
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get jenkins findings")
+		}
+		for _, f := range findings {
+			add(FindingRow{Service: ServiceJenkins, ID: f.ID, Host: f.TargetHost(), Rule: f.Rule, Secret: f.Secret,
+				File: f.File, StartLine: f.StartLine, URL: f.URL, FoundAt: f.CreatedAt, Processed: f.Processed})
+		}
+	}
+	return rows, nil
+}
+
+// QueryInstances returns the instances selected by filter, ordered by service and ID. Instances have no rule, so
+// filter.Rule matches the candidate pattern that selected their host instead.
+func (d *Database) QueryInstances(filter *ResultFilter) ([]InstanceRow, error) {
+	rows := []InstanceRow{}
+	add := func(row InstanceRow) {
+		if filter.matchesHost(row.Host) && (!filter.Validated || row.Validated) {
+			rows = append(rows, row)
+		}
+	}
+	if filter.includes(ServiceGitLab) {
+		// the credentials are not loaded, so that instances can be listed without the key
+		var gitLabs []struct {
+			GitLab
+			Validated bool
+		}
+		query := filter.apply(d.db.Model(&GitLab{}), "git_labs")
+		if filter.Rule != "" {
+			query = query.Where("reason = ?", filter.Rule)
+		}
+		err := query.Select("id", "created_at", "base_url", "reason", "processed", "email <> '' as validated").Order("id").Find(&gitLabs).Error
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get gitlab instances")
+		}
+		for _, g := range gitLabs {
+			add(InstanceRow{Service: ServiceGitLab, ID: g.ID, Host: g.TargetHost(), BaseURL: g.BaseURL, Reason: g.Reason,
+				FoundAt: g.CreatedAt, Processed: g.Processed, Validated: g.Validated})
+		}
+	}
+	if filter.includes(ServiceJenkins) {
+		var jenkins []Jenkins
+		query := filter.apply(d.db.Model(&Jenkins{}), "jenkins")
+		if filter.Rule != "" {
+			query = query.Where("reason = ?", filter.Rule)
+		}
+		err := query.Order("id").Find(&jenkins).Error
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get jenkins instances")
+		}
+		for _, j := range jenkins {
+			add(InstanceRow{Service: ServiceJenkins, ID: j.ID, Host: j.TargetHost(), BaseURL: j.BaseURL, Reason: j.Reason,
+				FoundAt: j.CreatedAt, Processed: j.Processed, Validated: j.AnonymousAPI})
+		}
+	}
+	return rows, nil
+}
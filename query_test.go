@@ -0,0 +1,80 @@
+package scanct
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryInstancesValidated(t *testing.T) {
+	db := testDatabase(t)
+	err := migrate(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetEncryptionKey(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostIDs := createHosts(t, &db, "gitlab.example.com", "closed.example.com", "jenkins.example.com", "ci.example.com")
+	for _, value := range []interface{}{
+		&GitLab{HostID: hostIDs[0], BaseURL: "https://gitlab.example.com", AllowSignup: true, Email: "scanct@example.com", Password: "secret"},
+		&GitLab{HostID: hostIDs[1], BaseURL: "https://closed.example.com"},
+		&Jenkins{HostID: hostIDs[2], BaseURL: "https://jenkins.example.com", AnonymousAPI: true},
+		&Jenkins{HostID: hostIDs[3], BaseURL: "https://ci.example.com"},
+	} {
+		err = db.db.Create(value).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := db.QueryInstances(&ResultFilter{Validated: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var urls []string
+	for _, row := range rows {
+		urls = append(urls, row.BaseURL)
+	}
+	if len(urls) != 2 || urls[0] != "https://gitlab.example.com" || urls[1] != "https://jenkins.example.com" {
+		t.Errorf("validated instances = %v, want the registered gitlab and the open jenkins", urls)
+	}
+}
+
+func TestQueryInstancesComparesTimesInUTC(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("UTC+2", 2*60*60)
+	defer func() { time.Local = local }()
+	db := testDatabase(t)
+	err := migrate(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostIDs := createHosts(t, &db, "gitlab.example.com")
+	// stored with the local offset like earlier versions did, 10:00 in UTC
+	found := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	err = db.db.Create(&GitLab{HostID: hostIDs[0], BaseURL: "https://gitlab.example.com", CreatedAt: found}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = utcCreatedAt(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		filter ResultFilter
+		want   int
+	}{
+		{ResultFilter{Since: time.Date(2026, 10, 17, 11, 0, 0, 0, time.UTC)}, 0},
+		{ResultFilter{Since: time.Date(2026, 10, 17, 11, 0, 0, 0, time.Local)}, 1},
+		{ResultFilter{Until: time.Date(2026, 10, 17, 11, 0, 0, 0, time.UTC)}, 1},
+		{ResultFilter{Until: time.Date(2026, 10, 17, 11, 0, 0, 0, time.Local)}, 0},
+	} {
+		rows, err := db.QueryInstances(&test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != test.want {
+			t.Errorf("filter since %v until %v matched %d instances, want %d", test.filter.Since, test.filter.Until, len(rows), test.want)
+		}
+	}
+}
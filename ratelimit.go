@@ -0,0 +1,196 @@
+package scanct
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitError is returned for requests that a log answered with 429 Too Many Requests or
+// 503 Service Unavailable. RetryAfter is zero if the log did not send a Retry-After header.
+type RateLimitError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return "rate limited with status " + strconv.Itoa(e.StatusCode) + ", retry after " + e.RetryAfter.String()
+}
+
+// LogLimiter is shared by all workers that send requests to the same log. It combines a token bucket for the
+// request rate with a limit on concurrent requests. The concurrency limit is halved whenever the log pushes back
+// and grows by one again after as many successful requests as the current limit.
+type LogLimiter struct {
+	rate           *rate.Limiter
+	mutex          sync.Mutex
+	changed        chan struct{}
+	active         int
+	limit          int
+	maxConcurrency int
+	successes      int
+	pausedUntil    time.Time
+}
+
+// NewLogLimiter returns a limiter for requestsPerSecond with up to maxConcurrency concurrent requests. A rate of
+// zero or less does not limit the request rate.
+func NewLogLimiter(requestsPerSecond float64, maxConcurrency int) *LogLimiter {
+	limit := rate.Limit(requestsPerSecond)
+	if requestsPerSecond <= 0 {
+		limit = rate.Inf
+	}
+	burst := int(requestsPerSecond)
+	if burst < 1 {
+		burst = 1
+	}
+	return &LogLimiter{
+		rate:           rate.NewLimiter(limit, burst),
+		changed:        make(chan struct{}),
+		limit:          maxConcurrency,
+		maxConcurrency: maxConcurrency,
+	}
+}
+
+func (l *LogLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mutex.Lock()
+		pause := time.Until(l.pausedUntil)
+		if l.active < l.limit && pause <= 0 {
+			l.active++
+			l.mutex.Unlock()
+			err := l.rate.Wait(ctx)
+			if err != nil {
+				// the request is never sent, so give the slot back without counting a success
+				l.mutex.Lock()
+				l.active--
+				l.broadcast()
+				l.mutex.Unlock()
+			}
+			return err
+		}
+		changed := l.changed
+		l.mutex.Unlock()
+
+		if pause <= 0 {
+			// wait for a request to finish
+			pause = time.Hour
+		}
+		timer := time.NewTimer(pause)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (l *LogLimiter) release(rateLimitErr *RateLimitError) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.active--
+	if rateLimitErr != nil {
+		l.successes = 0
+		l.limit /= 2
+		if l.limit < 1 {
+			l.limit = 1
+		}
+		pausedUntil := time.Now().Add(rateLimitErr.RetryAfter)
+		if pausedUntil.After(l.pausedUntil) {
+			l.pausedUntil = pausedUntil
+		}
+	} else {
+		l.successes++
+		if l.successes >= l.limit && l.limit < l.maxConcurrency {
+			l.successes = 0
+			l.limit++
+		}
+	}
+	l.broadcast()
+}
+
+// broadcast wakes up all goroutines waiting in acquire. The caller must hold the mutex.
+func (l *LogLimiter) broadcast() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// rateLimitTransport sends requests through a LogLimiter and turns push-back from the log into RateLimitErrors.
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	limiter *LogLimiter
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.limiter != nil {
+		err := t.limiter.acquire(req.Context())
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err := t.base.RoundTrip(req)
+	var rateLimitErr *RateLimitError
+	if err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		rateLimitErr = &RateLimitError{StatusCode: resp.StatusCode, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+		_ = resp.Body.Close()
+		resp, err = nil, rateLimitErr
+	}
+	if t.limiter != nil {
+		t.limiter.release(rateLimitErr)
+	}
+	return resp, err
+}
+
+// parseRetryAfter accepts both forms of the Retry-After header, a number of seconds or an HTTP date.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+const BackoffBase = 500 * time.Millisecond
+const BackoffMax = time.Minute
+
+// Backoff returns the delay before retry number attempt, counting from zero. The delay grows exponentially and is
+// jittered between half and the full value so that workers do not retry in lockstep. A Retry-After sent by the
+// log is never undercut.
+func Backoff(attempt int, err error) time.Duration {
+	delay := BackoffMax
+	if attempt < 16 {
+		delay = BackoffBase << attempt
+		if delay > BackoffMax {
+			delay = BackoffMax
+		}
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) && rateLimitErr.RetryAfter > delay {
+		delay = rateLimitErr.RetryAfter
+	}
+	return delay
+}
+
+// SleepContext waits for d or until ctx is done, whichever comes first.
+func SleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,79 @@
+package scanct
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLogLimiterReleasesSlotWhenContextExpires(t *testing.T) {
+	// one request per hour, so every request after the first has to wait for a token
+	limiter := NewLogLimiter(1.0/3600, 1)
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+	limiter.release(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := limiter.acquire(ctx); err == nil {
+		t.Fatal("acquire succeeded although no token is available before the deadline")
+	}
+
+	limiter.mutex.Lock()
+	active := limiter.active
+	limiter.mutex.Unlock()
+	if active != 0 {
+		t.Fatalf("active = %d after failed acquire, want 0", active)
+	}
+}
+
+func TestRateLimitTransportDoesNotLeakSlots(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	limiter := NewLogLimiter(1.0/3600, 2)
+	client := &http.Client{Transport: &rateLimitTransport{base: http.DefaultTransport, limiter: limiter}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	// the next requests time out waiting for a token; none of them may keep its slot
+	client.Timeout = 20 * time.Millisecond
+	for i := 0; i < 5; i++ {
+		resp, err = client.Get(server.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+			t.Fatalf("request %d succeeded although the limiter has no tokens", i)
+		}
+	}
+
+	limiter.mutex.Lock()
+	active, limit := limiter.active, limiter.limit
+	limiter.mutex.Unlock()
+	if active != 0 {
+		t.Fatalf("active = %d after timed out requests, want 0", active)
+	}
+	if limit != 2 {
+		t.Fatalf("limit = %d, want 2", limit)
+	}
+}
+
+func TestLogLimiterWithoutRate(t *testing.T) {
+	for _, requestsPerSecond := range []float64{0, -1} {
+		limiter := NewLogLimiter(requestsPerSecond, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		for i := 0; i < 100; i++ {
+			if err := limiter.acquire(ctx); err != nil {
+				t.Fatalf("acquire %d with %v requests per second: %v", i, requestsPerSecond, err)
+			}
+			limiter.release(nil)
+		}
+		cancel()
+	}
+}
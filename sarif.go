@@ -0,0 +1,250 @@
+package scanct
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// The types below are the subset of SARIF 2.1.0 that findings are exported as.
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool                     sarifTool              `json:"tool"`
+	AutomationDetails        sarifAutomationDetails `json:"automationDetails"`
+	VersionControlProvenance []sarifVersionControl  `json:"versionControlProvenance,omitempty"`
+	Results                  []sarifResult          `json:"results"`
+}
+
+type sarifVersionControl struct {
+	RepositoryURI string `json:"repositoryUri"`
+	RevisionID    string `json:"revisionId"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifAutomationDetails struct {
+	ID string `json:"id"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID          string            `json:"ruleId"`
+	RuleIndex       int               `json:"ruleIndex"`
+	Level           string            `json:"level"`
+	Message         sarifMessage      `json:"message"`
+	Locations       []sarifLocation   `json:"locations"`
+	HostedViewerURI string            `json:"hostedViewerUri,omitempty"`
+	Properties      map[string]string `json:"properties"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+	Properties       map[string]string     `json:"properties,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine,omitempty"`
+	EndLine   int `json:"endLine,omitempty"`
+}
+
+// sarifFinding is a GitLab or Jenkins finding before it is converted to a result. ArtifactURL is the clone URL of
+// the repository or the URL of the Jenkins job, and FileURL the URL of the file at the commit or in the workspace.
+type sarifFinding struct {
+	Rule        string
+	Secret      string
+	File        string
+	FileURL     string
+	StartLine   int
+	EndLine     int
+	Commit      string
+	ArtifactURL string
+	ViewerURL   string
+}
+
+// escapePath escapes every segment of the slash-separated path file for use in a URL.
+func escapePath(file string) string {
+	segments := strings.Split(file, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// newSARIFRun returns the run of service. Its rules are the gitleaks rules of findings in order of appearance, and
+// its version control provenance the repositories and commits of findings.
+func newSARIFRun(service string, findings []sarifFinding, showSecrets bool) sarifRun {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "scanct",
+			InformationURI: "https://github.com/rgwohlbold/scanct",
+			Rules:          []sarifRule{},
+		}},
+		AutomationDetails: sarifAutomationDetails{ID: service + "/"},
+		Results:           []sarifResult{},
+	}
+	ruleIndex := make(map[string]int)
+	revisions := make(map[sarifVersionControl]bool)
+	for _, f := range findings {
+		index, ok := ruleIndex[f.Rule]
+		if !ok {
+			index = len(run.Tool.Driver.Rules)
+			ruleIndex[f.Rule] = index
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{
+				ID:               f.Rule,
+				ShortDescription: sarifMessage{Text: fmt.Sprintf("Secret matched by gitleaks rule %s", f.Rule)},
+			})
+		}
+		secret := f.Secret
+		if !showSecrets {
+			secret = RedactSecret(secret)
+		}
+		properties := map[string]string{"artifactUrl": f.ArtifactURL, "file": f.File}
+		var locationProperties map[string]string
+		if f.Commit != "" {
+			properties["commit"] = f.Commit
+			// the location is a file at this commit, which only the provenance and these properties tell
+			locationProperties = map[string]string{"commit": f.Commit}
+			revision := sarifVersionControl{RepositoryURI: f.ArtifactURL, RevisionID: f.Commit}
+			if !revisions[revision] {
+				revisions[revision] = true
+				run.VersionControlProvenance = append(run.VersionControlProvenance, revision)
+			}
+		}
+		run.Results = append(run.Results, sarifResult{
+			RuleID:    f.Rule,
+			RuleIndex: index,
+			Level:     "error",
+			Message:   sarifMessage{Text: fmt.Sprintf("%s secret %s in %s", f.Rule, secret, f.ArtifactURL)},
+			Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: f.FileURL},
+				Region:           sarifRegion{StartLine: f.StartLine, EndLine: f.EndLine},
+			}, Properties: locationProperties}},
+			HostedViewerURI: f.ViewerURL,
+			Properties:      properties,
+		})
+	}
+	return run
+}
+
+// sarifLog returns all findings with one run for GitLab and one for Jenkins.
+func (d *Database) sarifLog(showSecrets bool) (sarifLog, error) {
+	var findings []Finding
+	err := d.db.Preload("Repository.GitLab").Order("id").Find(&findings).Error
+	if err != nil {
+		return sarifLog{}, errors.Wrap(err, "could not get findings")
+	}
+	gitLabFindings := make([]sarifFinding, 0, len(findings))
+	for _, f := range findings {
+		// the same path in two repositories or commits is a different artifact
+		cloneURL := f.Repository.CloneURL()
+		gitLabFindings = append(gitLabFindings, sarifFinding{
+			Rule:        f.Rule,
+			Secret:      f.Secret,
+			File:        f.File,
+			FileURL:     cloneURL + "/-/blob/" + url.PathEscape(f.Commit) + "/" + escapePath(f.File),
+			StartLine:   f.StartLine,
+			EndLine:     f.EndLine,
+			Commit:      f.Commit,
+			ArtifactURL: cloneURL,
+			ViewerURL:   f.URL,
+		})
+	}
+	var jenkinsFindings []JenkinsFinding
+	err = d.db.Preload("Job").Order("id").Find(&jenkinsFindings).Error
+	if err != nil {
+		return sarifLog{}, errors.Wrap(err, "could not get jenkins findings")
+	}
+	jobFindings := make([]sarifFinding, 0, len(jenkinsFindings))
+	for _, f := range jenkinsFindings {
+		// files are stored with the directory the workspace was extracted to, and the workspace archive holds a
+		// directory named after the job
+		file := strings.TrimPrefix(f.File, fmt.Sprintf("/tmp/%s/", Hash(f.Job.Name)))
+		workspaceFile := strings.TrimPrefix(file, f.Job.Name+"/")
+		jobFindings = append(jobFindings, sarifFinding{
+			Rule:        f.Rule,
+			Secret:      f.Secret,
+			File:        file,
+			FileURL:     f.Job.URL + "/ws/" + escapePath(workspaceFile),
+			StartLine:   f.StartLine,
+			EndLine:     f.EndLine,
+			ArtifactURL: f.Job.URL,
+		})
+	}
+	return sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{
+			newSARIFRun(ServiceGitLab, gitLabFindings, showSecrets),
+			newSARIFRun(ServiceJenkins, jobFindings, showSecrets),
+		},
+	}, nil
+}
+
+// WriteSARIF writes all GitLab and Jenkins findings to w as SARIF 2.1.0. Secrets are redacted unless showSecrets
+// is set.
+func (d *Database) WriteSARIF(w io.Writer, showSecrets bool) error {
+	sarif, err := d.sarifLog(showSecrets)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sarif)
+}
+
+// ExportSARIF writes all findings as SARIF to path, or to stdout if path is empty.
+func ExportSARIF(path string, showSecrets bool) {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	w := os.Stdout
+	if path != "" {
+		w, err = os.Create(path)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("could not create sarif file")
+		}
+		defer w.Close()
+	}
+	err = db.WriteSARIF(w, showSecrets)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not export sarif")
+	}
+}
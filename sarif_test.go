@@ -0,0 +1,96 @@
+package scanct
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSARIFLocationsAreFullURLs(t *testing.T) {
+	db := testDatabase(t)
+	err := migrate(db.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetEncryptionKey(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostIDs := createHosts(t, &db, "gitlab.example.com", "jenkins.example.com")
+	gitLab := GitLab{HostID: hostIDs[0], BaseURL: "https://gitlab.example.com"}
+	jenkins := Jenkins{HostID: hostIDs[1], BaseURL: "https://jenkins.example.com"}
+	for _, value := range []interface{}{&gitLab, &jenkins} {
+		err = db.db.Create(value).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	job := JenkinsJob{JenkinsID: jenkins.ID, Name: "deploy", URL: "https://jenkins.example.com/job/deploy"}
+	for _, value := range []interface{}{&job} {
+		err = db.db.Create(value).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	repositories := []Repository{{GitLabID: gitLab.ID, Name: "group/app"}, {GitLabID: gitLab.ID, Name: "group/tools"}}
+	err = db.db.Omit("GitLab").Create(&repositories).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []interface{}{
+		&Finding{RepositoryID: repositories[0].ID, Secret: "AKIA0", Commit: "abc123", File: "config/prod env.yml", StartLine: 3, EndLine: 3, Rule: "aws-access-token"},
+		&Finding{RepositoryID: repositories[1].ID, Secret: "AKIA1", Commit: "def456", File: "config/prod env.yml", StartLine: 3, EndLine: 3, Rule: "aws-access-token"},
+		&JenkinsFinding{JobID: job.ID, Secret: "ghp_0", File: fmt.Sprintf("/tmp/%s/deploy/scripts/run.sh", Hash("deploy")), StartLine: 7, EndLine: 7, Rule: "github-pat"},
+	} {
+		err = db.db.Omit("Repository", "Job").Create(value).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sarif, err := db.sarifLog(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{
+			"https://gitlab.example.com/group/app/-/blob/abc123/config/prod%20env.yml",
+			"https://gitlab.example.com/group/tools/-/blob/def456/config/prod%20env.yml",
+		},
+		{"https://jenkins.example.com/job/deploy/ws/scripts/run.sh"},
+	}
+	for i, run := range sarif.Runs {
+		if len(run.Results) != len(want[i]) {
+			t.Fatalf("run %d has %d results, want %d", i, len(run.Results), len(want[i]))
+		}
+		for j, result := range run.Results {
+			uri := result.Locations[0].PhysicalLocation.ArtifactLocation.URI
+			if uri != want[i][j] {
+				t.Errorf("result %d of run %d has uri %q, want %q", j, i, uri, want[i][j])
+			}
+		}
+	}
+	if file := sarif.Runs[1].Results[0].Properties["file"]; file != "deploy/scripts/run.sh" {
+		t.Errorf("jenkins file property = %q, want deploy/scripts/run.sh", file)
+	}
+
+	wantProvenance := []sarifVersionControl{
+		{RepositoryURI: "https://gitlab.example.com/group/app", RevisionID: "abc123"},
+		{RepositoryURI: "https://gitlab.example.com/group/tools", RevisionID: "def456"},
+	}
+	provenance := sarif.Runs[0].VersionControlProvenance
+	if len(provenance) != len(wantProvenance) {
+		t.Fatalf("gitlab run has provenance %v, want %v", provenance, wantProvenance)
+	}
+	for i := range wantProvenance {
+		if provenance[i] != wantProvenance[i] {
+			t.Errorf("provenance %d = %v, want %v", i, provenance[i], wantProvenance[i])
+		}
+		commit := sarif.Runs[0].Results[i].Locations[0].Properties["commit"]
+		if commit != wantProvenance[i].RevisionID {
+			t.Errorf("location of result %d has commit %q, want %q", i, commit, wantProvenance[i].RevisionID)
+		}
+	}
+	if len(sarif.Runs[1].VersionControlProvenance) != 0 || sarif.Runs[1].Results[0].Locations[0].Properties != nil {
+		t.Errorf("jenkins run has commits, want none")
+	}
+}
@@ -0,0 +1,126 @@
+package scanct
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Scope restricts scanning to the names below Domains, except those below Exclude. If CIDRs is set, connections
+// are only made to addresses in one of them. Empty Domains allow all names.
+type Scope struct {
+	Domains  []string `json:"domains"`
+	Exclude  []string `json:"exclude"`
+	CIDRs    []string `json:"cidrs"`
+	prefixes []netip.Prefix
+}
+
+// LoadScope reads a scope file.
+func LoadScope(path string) (*Scope, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read scope")
+	}
+	var scope Scope
+	err = json.Unmarshal(data, &scope)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse scope")
+	}
+	for i := range scope.Domains {
+		scope.Domains[i] = normalizeSuffix(scope.Domains[i])
+	}
+	for i := range scope.Exclude {
+		scope.Exclude[i] = normalizeSuffix(scope.Exclude[i])
+	}
+	scope.prefixes, err = parsePrefixes(scope.CIDRs)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse scope cidrs")
+	}
+	return &scope, nil
+}
+
+func inDomain(name string, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// AllowsHost reports whether the hostname or IP address host is in scope. A nil scope allows everything.
+func (s *Scope) AllowsHost(host string) bool {
+	if s == nil {
+		return true
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return len(s.Domains) == 0 && s.AllowsAddr(addr)
+	}
+	for _, exclusion := range s.Exclude {
+		if inDomain(host, exclusion) {
+			return false
+		}
+	}
+	if len(s.Domains) == 0 {
+		return true
+	}
+	for _, domain := range s.Domains {
+		if inDomain(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsAddr reports whether connections to addr are in scope.
+func (s *Scope) AllowsAddr(addr netip.Addr) bool {
+	return s == nil || len(s.prefixes) == 0 || containsAddr(s.prefixes, addr.Unmap())
+}
+
+var scope *Scope
+
+// SetScope restricts ingestion, process steps and connections to s. A nil scope allows everything.
+func SetScope(s *Scope) {
+	scope = s
+}
+
+// Target is implemented by the inputs of process steps that connect to a host. Inputs whose host is out of scope
+// are not processed.
+type Target interface {
+	TargetHost() string
+}
+
+func hostOfURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func (c Candidate) TargetHost() string {
+	return c.Name
+}
+
+func (g GitLab) TargetHost() string {
+	return hostOfURL(g.BaseURL)
+}
+
+func (j Jenkins) TargetHost() string {
+	return hostOfURL(j.BaseURL)
+}
+
+func (r Repository) TargetHost() string {
+	return hostOfURL(r.GitLab.BaseURL)
+}
+
+func (j JenkinsJob) TargetHost() string {
+	return hostOfURL(j.URL)
+}
+
+func (f Finding) TargetHost() string {
+	return hostOfURL(f.Repository.GitLab.BaseURL)
+}
+
+func (f JenkinsFinding) TargetHost() string {
+	return hostOfURL(f.Job.URL)
+}
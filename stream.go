@@ -0,0 +1,210 @@
+package scanct
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/websocket"
+	"strings"
+	"time"
+)
+
+// CertstreamMessage is a message of a certstream server. Only certificate_update messages carry a certificate.
+// CertIndex and Source are missing from some servers.
+type CertstreamMessage struct {
+	MessageType string `json:"message_type"`
+	Data        struct {
+		UpdateType string `json:"update_type"`
+		LeafCert   struct {
+			AllDomains []string `json:"all_domains"`
+			Issuer     struct {
+				Aggregated string `json:"aggregated"`
+			} `json:"issuer"`
+			SerialNumber string  `json:"serial_number"`
+			NotBefore    float64 `json:"not_before"`
+			NotAfter     float64 `json:"not_after"`
+		} `json:"leaf_cert"`
+		CertIndex *int64  `json:"cert_index"`
+		Seen      float64 `json:"seen"`
+		Source    struct {
+			URL  string `json:"url"`
+			Name string `json:"name"`
+		} `json:"source"`
+	} `json:"data"`
+}
+
+// CertstreamTimeout is the longest time without a message before the connection is considered dead. Servers send
+// heartbeats much more often.
+const CertstreamTimeout = 2 * time.Minute
+
+const certstreamFlushInterval = time.Second
+
+func unixSeconds(seconds float64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(int64(seconds * 1000)).UTC()
+}
+
+// Certificate returns the certificate described by message. Log and index are left to the caller.
+func (message *CertstreamMessage) Certificate() Certificate {
+	leaf := &message.Data.LeafCert
+	return Certificate{
+		Subjects:  Unique(leaf.AllDomains),
+		Issuer:    leaf.Issuer.Aggregated,
+		Serial:    strings.ToLower(strings.ReplaceAll(leaf.SerialNumber, ":", "")),
+		NotBefore: unixSeconds(leaf.NotBefore),
+		NotAfter:  unixSeconds(leaf.NotAfter),
+		Timestamp: unixSeconds(message.Data.Seen),
+		Precert:   message.Data.UpdateType == "PrecertLogEntry",
+	}
+}
+
+// receiveCertstream reads messages from a single connection to url until it fails. received is set once the first
+// message arrived.
+func receiveCertstream(url string, messages chan<- CertstreamMessage, received *bool) error {
+	ws, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		return errors.Wrap(err, "could not connect")
+	}
+	defer ws.Close()
+	log.Info().Str("stream", url).Msg("connected to certstream")
+	for {
+		err = ws.SetReadDeadline(time.Now().Add(CertstreamTimeout))
+		if err != nil {
+			return err
+		}
+		var data []byte
+		err = websocket.Message.Receive(ws, &data)
+		if err != nil {
+			return errors.Wrap(err, "could not receive message")
+		}
+		*received = true
+		var message CertstreamMessage
+		err = json.Unmarshal(data, &message)
+		if err != nil {
+			log.Warn().Err(err).Str("stream", url).Msg("could not parse message")
+			continue
+		}
+		if message.MessageType == "certificate_update" {
+			messages <- message
+		}
+	}
+}
+
+// CertstreamInputWorker receives the messages of the certstream server at url and reconnects with backoff whenever
+// the connection fails. It never returns.
+func CertstreamInputWorker(url string, messages chan<- CertstreamMessage) {
+	attempt := 0
+	for {
+		received := false
+		err := receiveCertstream(url, messages, &received)
+		if received {
+			attempt = 0
+		}
+		delay := Backoff(attempt, err)
+		log.Error().Err(err).Str("stream", url).Dur("delay", delay).Msg("certstream connection failed, reconnecting")
+		time.Sleep(delay)
+		attempt++
+	}
+}
+
+// certstreamWriter stores the certificates of certstream messages in batches. Stream data is unverified and
+// incomplete, so it is never stored under the CT log it claims to come from, where it would count as fetched.
+// All certificates are numbered in order of arrival under a log for the stream itself, and the claimed log and
+// index are kept as attributes.
+type certstreamWriter struct {
+	db        *Database
+	streamLog CTLog
+	nextIndex int64
+	certs     []Certificate
+	k         int
+}
+
+func newCertstreamWriter(db *Database, url string) (*certstreamWriter, error) {
+	streamLog, err := db.GetOrCreateCTLog(&CTLogConfig{URL: url})
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := db.GetFetchedRanges(&streamLog)
+	if err != nil {
+		return nil, err
+	}
+	w := &certstreamWriter{
+		db:        db,
+		streamLog: streamLog,
+	}
+	if len(ranges) > 0 {
+		w.nextIndex = ranges[len(ranges)-1].EndIndex + 1
+	}
+	return w, nil
+}
+
+func (w *certstreamWriter) add(message *CertstreamMessage) {
+	cert := message.Certificate()
+	if message.Data.CertIndex != nil && message.Data.Source.URL != "" {
+		cert.SourceURL = message.Data.Source.URL
+		if !strings.Contains(cert.SourceURL, "://") {
+			cert.SourceURL = "https://" + cert.SourceURL
+		}
+		index := *message.Data.CertIndex
+		cert.SourceIndex = &index
+	}
+	cert.CTLogID = w.streamLog.ID
+	cert.Index = w.nextIndex
+	w.nextIndex++
+	w.certs = append(w.certs, cert)
+}
+
+// flush stores the buffered certificates as one batch of the stream log.
+func (w *certstreamWriter) flush() error {
+	if len(w.certs) == 0 {
+		return nil
+	}
+	batch := CTBatch{Log: &w.streamLog, Start: w.certs[0].Index, End: w.certs[len(w.certs)-1].Index, Certificates: w.certs}
+	_, err := w.db.StoreBatch(&batch)
+	if err != nil {
+		return err
+	}
+	w.k += len(w.certs)
+	log.Debug().Int("certs", w.k).Msg("processed certs")
+	w.certs = nil
+	return nil
+}
+
+// StreamCertificates stores the certificates announced by the certstream server at url until the process is
+// stopped. Certificates are stored at least every second, or once GetEntriesBatchSize of them arrived.
+func StreamCertificates(config *CTConfig, url string) {
+	db, err := NewDatabase()
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not open database")
+	}
+	defer db.Close()
+	err = db.SetIngestRules(&config.Ingest)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid ingest rules")
+	}
+	w, err := newCertstreamWriter(&db, url)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not get log for stream")
+	}
+	messages := make(chan CertstreamMessage, 1000)
+	go CertstreamInputWorker(url, messages)
+
+	ticker := time.NewTicker(certstreamFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case message := <-messages:
+			w.add(&message)
+			if int64(len(w.certs)) < config.GetEntriesBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		err = w.flush()
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not store certificates")
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package scanct
+
+import (
+	"encoding/json"
+	"golang.org/x/net/websocket"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	certstreamHeartbeat    = `{"message_type": "heartbeat", "timestamp": 1700000000.0}`
+	certstreamWithIndex    = `{"message_type": "certificate_update", "data": {"update_type": "X509LogEntry", "leaf_cert": {"all_domains": ["a.example.com", "a.example.com"], "serial_number": "0A:BC", "not_before": 1700000000, "not_after": 1710000000}, "cert_index": 42, "seen": 1700000001.5, "source": {"url": "ct.example.org/log/", "name": "Example"}}}`
+	certstreamWithoutIndex = `{"message_type": "certificate_update", "data": {"update_type": "PrecertLogEntry", "leaf_cert": {"all_domains": ["b.example.com"]}, "seen": 1700000002}}`
+)
+
+// certstreamStandIn serves the messages of connections[i] on the i-th connection and then drops it.
+func certstreamStandIn(t *testing.T, connections [][]string) *httptest.Server {
+	var mutex sync.Mutex
+	count := 0
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		mutex.Lock()
+		i := count
+		count++
+		mutex.Unlock()
+		if i >= len(connections) {
+			// keep later connections open without messages
+			time.Sleep(time.Minute)
+			return
+		}
+		for _, message := range connections[i] {
+			err := websocket.Message.Send(ws, message)
+			if err != nil {
+				t.Errorf("could not send message: %v", err)
+				return
+			}
+		}
+	}))
+	return server
+}
+
+func receiveMessages(t *testing.T, messages <-chan CertstreamMessage, n int) []CertstreamMessage {
+	var received []CertstreamMessage
+	timeout := time.After(10 * time.Second)
+	for len(received) < n {
+		select {
+		case message := <-messages:
+			received = append(received, message)
+		case <-timeout:
+			t.Fatalf("received %d messages, want %d", len(received), n)
+		}
+	}
+	return received
+}
+
+func TestCertstreamInputWorkerReconnects(t *testing.T) {
+	server := certstreamStandIn(t, [][]string{
+		{certstreamHeartbeat, certstreamWithIndex, "not json"},
+		{certstreamWithoutIndex},
+	})
+	defer server.Close()
+
+	messages := make(chan CertstreamMessage)
+	go CertstreamInputWorker("ws"+server.URL[len("http"):], messages)
+
+	received := receiveMessages(t, messages, 2)
+	if received[0].Data.CertIndex == nil || *received[0].Data.CertIndex != 42 {
+		t.Errorf("first message has cert_index %v, want 42", received[0].Data.CertIndex)
+	}
+	if received[1].Data.CertIndex != nil {
+		t.Errorf("second message has cert_index %d, want none", *received[1].Data.CertIndex)
+	}
+}
+
+func TestCertstreamWriterKeepsSourceAsAttributes(t *testing.T) {
+	w := &certstreamWriter{streamLog: CTLog{ID: 7, URL: "wss://certstream.example.com"}, nextIndex: 10}
+	for _, data := range []string{certstreamWithIndex, certstreamWithoutIndex} {
+		var message CertstreamMessage
+		err := json.Unmarshal([]byte(data), &message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.add(&message)
+	}
+	if len(w.certs) != 2 {
+		t.Fatalf("buffered %d certificates, want 2", len(w.certs))
+	}
+	for i, cert := range w.certs {
+		if cert.CTLogID != 7 || cert.Index != int64(10+i) {
+			t.Errorf("certificate %d is stored at log %d index %d, want log 7 index %d", i, cert.CTLogID, cert.Index, 10+i)
+		}
+	}
+	withIndex := w.certs[0]
+	if withIndex.SourceURL != "https://ct.example.org/log/" || withIndex.SourceIndex == nil || *withIndex.SourceIndex != 42 {
+		t.Errorf("source = %q %v, want https://ct.example.org/log/ 42", withIndex.SourceURL, withIndex.SourceIndex)
+	}
+	if len(withIndex.Subjects) != 1 || withIndex.Serial != "0abc" || withIndex.Precert {
+		t.Errorf("certificate = %+v", withIndex)
+	}
+	withoutIndex := w.certs[1]
+	if withoutIndex.SourceURL != "" || withoutIndex.SourceIndex != nil || !withoutIndex.Precert {
+		t.Errorf("certificate = %+v", withoutIndex)
+	}
+}
@@ -0,0 +1,429 @@
+package scanct
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/tls"
+	"github.com/google/certificate-transparency-go/x509"
+	"github.com/pkg/errors"
+	"github.com/transparency-dev/merkle/compact"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TileWidth is the number of entries or hashes in a full tile, see c2sp.org/static-ct-api.
+const TileWidth = 256
+
+// tileHeight is the number of tree levels covered by a hash tile.
+const tileHeight = 8
+
+// ErrInvalidCheckpoint is returned for checkpoints that cannot be parsed or are not signed by the log.
+var ErrInvalidCheckpoint = errors.New("invalid checkpoint")
+
+var errTileNotFound = errors.New("tile not found")
+
+// TileClient reads a log that implements the static CT API instead of RFC 6962. Entries are read from data tiles
+// and converted to the leaf entries of get-entries, proofs are computed from hash tiles. Full tiles and issuers
+// never change, so they are cached in cacheDir if it is set. Partial tiles are only used until the full tile exists.
+type TileClient struct {
+	monitoringURL string
+	origin        string
+	keyID         []byte
+	verifier      *ct.SignatureVerifier
+	httpClient    *http.Client
+	cacheDir      string
+
+	mutex    sync.Mutex
+	treeSize uint64
+	issuers  map[[sha256.Size]byte][]byte
+}
+
+// NewTileClient creates a client for ctLog, whose URL is the submission prefix and whose MonitoringURL is the
+// monitoring prefix. The checkpoint origin is the submission prefix without scheme.
+func NewTileClient(ctLog *CTLog, httpClient *http.Client, cacheDir string) (*TileClient, error) {
+	origin := strings.TrimSuffix(ctLog.URL, "/")
+	if i := strings.Index(origin, "://"); i >= 0 {
+		origin = origin[i+3:]
+	}
+	c := &TileClient{
+		monitoringURL: strings.TrimSuffix(ctLog.MonitoringURL, "/"),
+		origin:        origin,
+		httpClient:    httpClient,
+		treeSize:      ctLog.TreeSize,
+		issuers:       make(map[[sha256.Size]byte][]byte),
+	}
+	if cacheDir != "" {
+		c.cacheDir = filepath.Join(cacheDir, filepath.FromSlash(origin))
+	}
+	if len(ctLog.PublicKey) > 0 {
+		publicKey, err := x509.ParsePKIXPublicKey(ctLog.PublicKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse public key")
+		}
+		c.verifier, err = ct.NewSignatureVerifier(publicKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create signature verifier")
+		}
+		// RFC 6962 note signatures are identified by the hash of the key name, the signature type 0x05 and the key
+		keyID := sha256.Sum256(append([]byte(origin+"\n\x05"), ctLog.PublicKey...))
+		c.keyID = keyID[:4]
+	}
+	return c, nil
+}
+
+// tilePath encodes n in groups of three digits, where all groups but the last are prefixed with x.
+func tilePath(n uint64) string {
+	path := fmt.Sprintf("%03d", n%1000)
+	for n >= 1000 {
+		n /= 1000
+		path = fmt.Sprintf("x%03d/%s", n%1000, path)
+	}
+	return path
+}
+
+func (c *TileClient) fetch(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.monitoringURL+"/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errors.Wrap(errTileNotFound, path)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("bad status code %d for %s", resp.StatusCode, path)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// fetchCached is fetch for resources that never change.
+func (c *TileClient) fetchCached(ctx context.Context, path string) ([]byte, error) {
+	if c.cacheDir == "" {
+		return c.fetch(ctx, path)
+	}
+	cachePath := filepath.Join(c.cacheDir, filepath.FromSlash(path))
+	data, err := os.ReadFile(cachePath)
+	if err == nil {
+		return data, nil
+	}
+	data, err = c.fetch(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(cachePath), 0o755)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create tile cache")
+	}
+	// write to a temporary file first, so that other workers never read a partially written tile
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), filepath.Base(cachePath)+".*")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create tile cache")
+	}
+	_, err = tmp.Write(data)
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), cachePath)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, errors.Wrap(err, "could not write tile cache")
+	}
+	return data, nil
+}
+
+// fetchTile returns the first width entries of tile n in directory tile/<level>. Partial tiles are removed once
+// the full tile is published, so the full tile is tried if a partial one is missing.
+func (c *TileClient) fetchTile(ctx context.Context, level string, n uint64, width uint64) ([]byte, error) {
+	path := "tile/" + level + "/" + tilePath(n)
+	if width == TileWidth {
+		return c.fetchCached(ctx, path)
+	}
+	data, err := c.fetch(ctx, path+".p/"+strconv.FormatUint(width, 10))
+	if errors.Is(err, errTileNotFound) {
+		return c.fetchCached(ctx, path)
+	}
+	return data, err
+}
+
+func (c *TileClient) size() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.treeSize
+}
+
+// GetSTH fetches the checkpoint of the log and returns it as a signed tree head. The signature is verified if the
+// log has a public key.
+func (c *TileClient) GetSTH(ctx context.Context) (*ct.SignedTreeHead, error) {
+	data, err := c.fetch(ctx, "checkpoint")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get checkpoint")
+	}
+	sth, err := c.parseCheckpoint(data)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	if sth.TreeSize > c.treeSize {
+		c.treeSize = sth.TreeSize
+	}
+	c.mutex.Unlock()
+	return sth, nil
+}
+
+func (c *TileClient) parseCheckpoint(data []byte) (*ct.SignedTreeHead, error) {
+	text, signatures, found := strings.Cut(string(data), "\n\n")
+	if !found {
+		return nil, fmt.Errorf("%w: no signatures", ErrInvalidCheckpoint)
+	}
+	lines := strings.Split(text, "\n")
+	if len(lines) < 3 {
+		return nil, fmt.Errorf("%w: missing lines", ErrInvalidCheckpoint)
+	}
+	if lines[0] != c.origin {
+		return nil, fmt.Errorf("%w: origin %q", ErrInvalidCheckpoint, lines[0])
+	}
+	treeSize, err := strconv.ParseUint(lines[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: tree size %q", ErrInvalidCheckpoint, lines[1])
+	}
+	rootHash, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || len(rootHash) != sha256.Size {
+		return nil, fmt.Errorf("%w: root hash %q", ErrInvalidCheckpoint, lines[2])
+	}
+	for _, line := range strings.Split(signatures, "\n") {
+		if !strings.HasPrefix(line, "— ") {
+			continue
+		}
+		name, encoded, _ := strings.Cut(strings.TrimPrefix(line, "— "), " ")
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		// other signatures, such as those of witnesses, are ignored
+		if name != c.origin || err != nil || len(signature) < 12 {
+			continue
+		}
+		if c.keyID != nil && !bytes.Equal(signature[:4], c.keyID) {
+			continue
+		}
+		sth := &ct.SignedTreeHead{
+			Version:   ct.V1,
+			TreeSize:  treeSize,
+			Timestamp: binary.BigEndian.Uint64(signature[4:12]),
+		}
+		copy(sth.SHA256RootHash[:], rootHash)
+		rest, err := tls.Unmarshal(signature[12:], &sth.TreeHeadSignature)
+		if err != nil || len(rest) > 0 {
+			return nil, fmt.Errorf("%w: malformed signature", ErrInvalidCheckpoint)
+		}
+		if c.verifier != nil {
+			err = c.verifier.VerifySTHSignature(*sth)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidCheckpoint, err)
+			}
+		}
+		return sth, nil
+	}
+	return nil, fmt.Errorf("%w: no signature by the log", ErrInvalidCheckpoint)
+}
+
+// tileLeafChain is the end of a data tile entry: the fingerprints of the issuers of the certificate.
+type tileLeafChain struct {
+	Fingerprints [][sha256.Size]byte `tls:"minlen:0,maxlen:65535"`
+}
+
+func (c *TileClient) issuer(ctx context.Context, fingerprint [sha256.Size]byte) ([]byte, error) {
+	c.mutex.Lock()
+	der, ok := c.issuers[fingerprint]
+	c.mutex.Unlock()
+	if ok {
+		return der, nil
+	}
+	der, err := c.fetchCached(ctx, "issuer/"+hex.EncodeToString(fingerprint[:]))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get issuer")
+	}
+	if sha256.Sum256(der) != fingerprint {
+		return nil, errors.Errorf("issuer does not match fingerprint %x", fingerprint)
+	}
+	c.mutex.Lock()
+	c.issuers[fingerprint] = der
+	c.mutex.Unlock()
+	return der, nil
+}
+
+// parseDataTile converts the entries of a data tile to the leaf entries that get-entries would have returned.
+func (c *TileClient) parseDataTile(ctx context.Context, data []byte) ([]ct.LeafEntry, error) {
+	var entries []ct.LeafEntry
+	for len(data) > 0 {
+		var entry ct.TimestampedEntry
+		var preCertificate ct.ASN1Cert
+		var chain tileLeafChain
+		var err error
+		data, err = tls.Unmarshal(data, &entry)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse timestamped entry")
+		}
+		if entry.EntryType == ct.PrecertLogEntryType {
+			data, err = tls.Unmarshal(data, &preCertificate)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not parse precertificate")
+			}
+		}
+		data, err = tls.Unmarshal(data, &chain)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not parse certificate chain")
+		}
+		leafInput, err := tls.Marshal(ct.MerkleTreeLeaf{
+			Version:          ct.V1,
+			LeafType:         ct.TimestampedEntryLeafType,
+			TimestampedEntry: &entry,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create leaf")
+		}
+		issuers := make([]ct.ASN1Cert, len(chain.Fingerprints))
+		for i, fingerprint := range chain.Fingerprints {
+			issuers[i].Data, err = c.issuer(ctx, fingerprint)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var extraData []byte
+		if entry.EntryType == ct.PrecertLogEntryType {
+			extraData, err = tls.Marshal(ct.PrecertChainEntry{PreCertificate: preCertificate, CertificateChain: issuers})
+		} else {
+			extraData, err = tls.Marshal(ct.CertificateChain{Entries: issuers})
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create extra data")
+		}
+		entries = append(entries, ct.LeafEntry{LeafInput: leafInput, ExtraData: extraData})
+	}
+	return entries, nil
+}
+
+// GetRawEntries reads the entries from start to end, inclusive, from the data tiles. Like get-entries, it returns
+// fewer entries if end is beyond the tree size.
+func (c *TileClient) GetRawEntries(ctx context.Context, start, end int64) (*ct.GetEntriesResponse, error) {
+	treeSize := c.size()
+	if uint64(end) >= treeSize {
+		_, err := c.GetSTH(ctx)
+		if err != nil {
+			return nil, err
+		}
+		treeSize = c.size()
+	}
+	if uint64(start) >= treeSize {
+		return nil, errors.Errorf("start %d is beyond tree size %d", start, treeSize)
+	}
+	if uint64(end) >= treeSize {
+		end = int64(treeSize) - 1
+	}
+	resp := &ct.GetEntriesResponse{}
+	for n := uint64(start) / TileWidth; n <= uint64(end)/TileWidth; n++ {
+		width := treeSize - n*TileWidth
+		if width > TileWidth {
+			width = TileWidth
+		}
+		data, err := c.fetchTile(ctx, "data", n, width)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get data tile")
+		}
+		entries, err := c.parseDataTile(ctx, data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse data tile %d", n)
+		}
+		if uint64(len(entries)) < width {
+			return nil, errors.Errorf("data tile %d has %d entries instead of %d", n, len(entries), width)
+		}
+		first := n * TileWidth
+		for i := range entries[:width] {
+			index := int64(first) + int64(i)
+			if index >= start && index <= end {
+				resp.Entries = append(resp.Entries, entries[i])
+			}
+		}
+	}
+	return resp, nil
+}
+
+// nodeHash computes the hash of the perfect subtree id in the tree of size treeSize from the hash tile that holds
+// its leftmost descendants at the bottom level of the tile.
+func (c *TileClient) nodeHash(ctx context.Context, id compact.NodeID, treeSize uint64) ([]byte, error) {
+	tileLevel := id.Level / tileHeight
+	height := id.Level % tileHeight
+	begin := id.Index << height
+	n := begin / TileWidth
+	width := (treeSize >> (tileLevel * tileHeight)) - n*TileWidth
+	if width > TileWidth {
+		width = TileWidth
+	}
+	data, err := c.fetchTile(ctx, strconv.FormatUint(uint64(tileLevel), 10), n, width)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get hash tile")
+	}
+	offset := begin % TileWidth
+	count := uint64(1) << height
+	if uint64(len(data)) < (offset+count)*sha256.Size {
+		return nil, errors.Errorf("hash tile %d at level %d is too short", n, tileLevel)
+	}
+	hashes := make([][]byte, count)
+	for i := range hashes {
+		hashes[i] = data[(offset+uint64(i))*sha256.Size : (offset+uint64(i)+1)*sha256.Size]
+	}
+	for len(hashes) > 1 {
+		for i := 0; i < len(hashes)/2; i++ {
+			hashes[i] = rfc6962.DefaultHasher.HashChildren(hashes[2*i], hashes[2*i+1])
+		}
+		hashes = hashes[:len(hashes)/2]
+	}
+	return hashes[0], nil
+}
+
+func (c *TileClient) proofHashes(ctx context.Context, nodes proof.Nodes, treeSize uint64) ([][]byte, error) {
+	hashes := make([][]byte, len(nodes.IDs))
+	for i, id := range nodes.IDs {
+		var err error
+		hashes[i], err = c.nodeHash(ctx, id, treeSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nodes.Rehash(hashes, rfc6962.DefaultHasher.HashChildren)
+}
+
+// GetSTHConsistency computes the consistency proof between the trees of size first and second from hash tiles.
+func (c *TileClient) GetSTHConsistency(ctx context.Context, first, second uint64) ([][]byte, error) {
+	nodes, err := proof.Consistency(first, second)
+	if err != nil {
+		return nil, err
+	}
+	return c.proofHashes(ctx, nodes, second)
+}
+
+// GetInclusionProof computes the inclusion proof for the entry at index in the tree of size treeSize from hash
+// tiles.
+func (c *TileClient) GetInclusionProof(ctx context.Context, index int64, leafHash []byte, treeSize uint64) ([][]byte, error) {
+	nodes, err := proof.Inclusion(uint64(index), treeSize)
+	if err != nil {
+		return nil, err
+	}
+	return c.proofHashes(ctx, nodes, treeSize)
+}
@@ -0,0 +1,414 @@
+package scanct
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/tls"
+	"github.com/pkg/errors"
+	"github.com/transparency-dev/merkle/rfc6962"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+const testOrigin = "log.example.com/2025h1"
+
+var testIssuer = []byte("issuer certificate")
+
+// testTree is a static CT API log of size entries written to a directory.
+type testTree struct {
+	dir        string
+	size       uint64
+	rootHash   []byte
+	leafInputs [][]byte
+	publicKey  []byte
+}
+
+func testEntry(i uint64) (ct.TimestampedEntry, []byte) {
+	entry := ct.TimestampedEntry{Timestamp: 1700000000000 + i}
+	var preCertificate []byte
+	if i%10 == 3 {
+		entry.EntryType = ct.PrecertLogEntryType
+		entry.PrecertEntry = &ct.PreCert{TBSCertificate: []byte(fmt.Sprintf("tbs %d", i))}
+		preCertificate = []byte(fmt.Sprintf("precert %d", i))
+	} else {
+		entry.EntryType = ct.X509LogEntryType
+		entry.X509Entry = &ct.ASN1Cert{Data: []byte(fmt.Sprintf("cert %d", i))}
+	}
+	return entry, preCertificate
+}
+
+// rootHash computes the RFC 6962 tree hash of leafHashes.
+func rootHash(leafHashes [][]byte) []byte {
+	if len(leafHashes) == 1 {
+		return leafHashes[0]
+	}
+	k := 1
+	for k*2 < len(leafHashes) {
+		k *= 2
+	}
+	return rfc6962.DefaultHasher.HashChildren(rootHash(leafHashes[:k]), rootHash(leafHashes[k:]))
+}
+
+func writeTestFile(t *testing.T, dir, path string, data []byte) {
+	path = filepath.Join(dir, filepath.FromSlash(path))
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTiles writes the tiles of level whose hashes or entries are given by items, each 256 of them a full tile.
+// The last tile is written as a partial tile unless withPartial is false.
+func writeTiles(t *testing.T, dir, level string, items [][]byte, withPartial bool) {
+	for n := 0; n*TileWidth < len(items); n++ {
+		end := (n + 1) * TileWidth
+		path := "tile/" + level + "/" + tilePath(uint64(n))
+		if end > len(items) {
+			if !withPartial {
+				continue
+			}
+			end = len(items)
+			path += ".p/" + strconv.Itoa(end-n*TileWidth)
+		}
+		var data []byte
+		for _, item := range items[n*TileWidth : end] {
+			data = append(data, item...)
+		}
+		writeTestFile(t, dir, path, data)
+	}
+}
+
+// newTestTree writes a log of size entries. Only full tiles are written for entries beyond partialSize, as if the
+// log had grown from partialSize to size and removed the partial tiles.
+func newTestTree(t *testing.T, size uint64, partialSize uint64) *testTree {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := &testTree{dir: t.TempDir(), size: size, publicKey: publicKey}
+	issuerFingerprint := sha256.Sum256(testIssuer)
+	writeTestFile(t, tree.dir, "issuer/"+hex.EncodeToString(issuerFingerprint[:]), testIssuer)
+
+	var entries, leafHashes [][]byte
+	for i := uint64(0); i < size; i++ {
+		entry, preCertificate := testEntry(i)
+		data, err := tls.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if preCertificate != nil {
+			encoded, err := tls.Marshal(ct.ASN1Cert{Data: preCertificate})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, encoded...)
+		}
+		chain, err := tls.Marshal(tileLeafChain{Fingerprints: [][sha256.Size]byte{issuerFingerprint}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, append(data, chain...))
+		leafInput, err := tls.Marshal(ct.MerkleTreeLeaf{Version: ct.V1, LeafType: ct.TimestampedEntryLeafType, TimestampedEntry: &entry})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.leafInputs = append(tree.leafInputs, leafInput)
+		leafHashes = append(leafHashes, rfc6962.DefaultHasher.HashLeaf(leafInput))
+	}
+	tree.rootHash = rootHash(leafHashes)
+
+	for _, tileSize := range []uint64{partialSize, size} {
+		withPartial := tileSize == partialSize
+		writeTiles(t, tree.dir, "data", entries[:tileSize], withPartial)
+		writeTiles(t, tree.dir, "0", leafHashes[:tileSize], withPartial)
+		var subtreeHashes [][]byte
+		for n := 0; (n+1)*TileWidth <= int(tileSize); n++ {
+			subtreeHashes = append(subtreeHashes, rootHash(leafHashes[n*TileWidth:(n+1)*TileWidth]))
+		}
+		writeTiles(t, tree.dir, "1", subtreeHashes, withPartial)
+	}
+	writeTestFile(t, tree.dir, "checkpoint", tree.checkpoint(t, key))
+	return tree
+}
+
+// checkpoint returns the checkpoint of the tree signed with key.
+func (tree *testTree) checkpoint(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	sth := ct.SignedTreeHead{Version: ct.V1, TreeSize: tree.size, Timestamp: 1700000000000 + tree.size}
+	copy(sth.SHA256RootHash[:], tree.rootHash)
+	input, err := ct.SerializeSTHSignatureInput(sth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := tls.CreateSignature(*key, tls.SHA256, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := tls.Marshal(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := sha256.Sum256(append([]byte(testOrigin+"\n\x05"), tree.publicKey...))
+	note := append([]byte{}, keyID[:4]...)
+	note = binary.BigEndian.AppendUint64(note, sth.Timestamp)
+	note = append(note, encoded...)
+	return []byte(fmt.Sprintf("%s\n%d\n%s\n\n— witness.example.com AAAAAA==\n— %s %s\n", testOrigin, tree.size,
+		base64.StdEncoding.EncodeToString(tree.rootHash), testOrigin, base64.StdEncoding.EncodeToString(note)))
+}
+
+// testTileServer serves a directory and records the requested paths.
+type testTileServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests map[string]int
+}
+
+func newTestTileServer(dir string) *testTileServer {
+	s := &testTileServer{requests: make(map[string]int)}
+	fileServer := http.FileServer(http.Dir(dir))
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.requests[r.URL.Path]++
+		s.mutex.Unlock()
+		fileServer.ServeHTTP(w, r)
+	}))
+	return s
+}
+
+func (s *testTileServer) count(path string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests[path]
+}
+
+func (s *testTileServer) client(t *testing.T, publicKey []byte, treeSize uint64, cacheDir string) *TileClient {
+	ctLog := &CTLog{URL: "https://" + testOrigin + "/", MonitoringURL: s.URL + "/", PublicKey: publicKey, TreeSize: treeSize}
+	c, err := NewTileClient(ctLog, s.Client(), cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func checkEntries(t *testing.T, tree *testTree, resp *ct.GetEntriesResponse, start, end int64) {
+	if int64(len(resp.Entries)) != end-start+1 {
+		t.Fatalf("got %d entries, want %d", len(resp.Entries), end-start+1)
+	}
+	for i, leafEntry := range resp.Entries {
+		index := start + int64(i)
+		if string(leafEntry.LeafInput) != string(tree.leafInputs[index]) {
+			t.Fatalf("leaf input of entry %d does not match", index)
+		}
+		_, preCertificate := testEntry(uint64(index))
+		var chain []ct.ASN1Cert
+		if preCertificate != nil {
+			var extraData ct.PrecertChainEntry
+			_, err := tls.Unmarshal(leafEntry.ExtraData, &extraData)
+			if err != nil {
+				t.Fatalf("could not parse extra data of entry %d: %v", index, err)
+			}
+			if string(extraData.PreCertificate.Data) != string(preCertificate) {
+				t.Fatalf("precertificate of entry %d does not match", index)
+			}
+			chain = extraData.CertificateChain
+		} else {
+			var extraData ct.CertificateChain
+			_, err := tls.Unmarshal(leafEntry.ExtraData, &extraData)
+			if err != nil {
+				t.Fatalf("could not parse extra data of entry %d: %v", index, err)
+			}
+			chain = extraData.Entries
+		}
+		if len(chain) != 1 || string(chain[0].Data) != string(testIssuer) {
+			t.Fatalf("chain of entry %d is %v, want the issuer", index, chain)
+		}
+	}
+}
+
+func TestTileClientCheckpoint(t *testing.T) {
+	tree := newTestTree(t, 300, 300)
+	server := newTestTileServer(tree.dir)
+	defer server.Close()
+
+	sth, err := server.client(t, tree.publicKey, 0, "").GetSTH(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sth.TreeSize != 300 || string(sth.SHA256RootHash[:]) != string(tree.rootHash) {
+		t.Fatalf("sth has tree size %d and root %x, want 300 and %x", sth.TreeSize, sth.SHA256RootHash, tree.rootHash)
+	}
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, tree.dir, "checkpoint", tree.checkpoint(t, otherKey))
+	_, err = server.client(t, tree.publicKey, 0, "").GetSTH(context.Background())
+	if !errors.Is(err, ErrInvalidCheckpoint) {
+		t.Fatalf("checkpoint signed by another key: got %v, want ErrInvalidCheckpoint", err)
+	}
+
+	for name, checkpoint := range map[string]string{
+		"no signatures": testOrigin + "\n300\n" + base64.StdEncoding.EncodeToString(tree.rootHash) + "\n",
+		"wrong origin":  "other.example.com\n300\n" + base64.StdEncoding.EncodeToString(tree.rootHash) + "\n\n— other.example.com AAAAAAAAAAAAAAAA\n",
+		"bad tree size": testOrigin + "\nthree\n" + base64.StdEncoding.EncodeToString(tree.rootHash) + "\n\n— " + testOrigin + " AAAAAAAAAAAAAAAA\n",
+	} {
+		writeTestFile(t, tree.dir, "checkpoint", []byte(checkpoint))
+		_, err = server.client(t, tree.publicKey, 0, "").GetSTH(context.Background())
+		if !errors.Is(err, ErrInvalidCheckpoint) {
+			t.Errorf("%s: got %v, want ErrInvalidCheckpoint", name, err)
+		}
+	}
+}
+
+func TestTileClientEntries(t *testing.T) {
+	tree := newTestTree(t, 300, 300)
+	server := newTestTileServer(tree.dir)
+	defer server.Close()
+	c := server.client(t, tree.publicKey, 300, "")
+
+	resp, err := c.GetRawEntries(context.Background(), 250, 299)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, tree, resp, 250, 299)
+	if server.count("/tile/data/000") != 1 || server.count("/tile/data/001.p/44") != 1 {
+		t.Fatalf("requests = %v, want the full tile 0 and the partial tile 1", server.requests)
+	}
+
+	// like get-entries, the response ends at the tree size
+	resp, err = c.GetRawEntries(context.Background(), 290, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, tree, resp, 290, 299)
+	fingerprint := sha256.Sum256(testIssuer)
+	if server.count("/issuer/"+hex.EncodeToString(fingerprint[:])) != 1 {
+		t.Fatalf("requests = %v, want the issuer to be fetched once", server.requests)
+	}
+
+	_, err = c.GetRawEntries(context.Background(), 300, 310)
+	if err == nil {
+		t.Fatal("got entries beyond the tree size")
+	}
+}
+
+func TestTileClientPartialTileFallback(t *testing.T) {
+	// the log grew to 512 entries and removed the partial tiles of size 300
+	tree := newTestTree(t, 512, 512)
+	server := newTestTileServer(tree.dir)
+	defer server.Close()
+	c := server.client(t, tree.publicKey, 300, "")
+
+	resp, err := c.GetRawEntries(context.Background(), 256, 299)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, tree, resp, 256, 299)
+	if server.count("/tile/data/001.p/44") != 1 || server.count("/tile/data/001") != 1 {
+		t.Fatalf("requests = %v, want the partial tile and then the full tile", server.requests)
+	}
+}
+
+func TestTileClientCache(t *testing.T) {
+	tree := newTestTree(t, 300, 300)
+	server := newTestTileServer(tree.dir)
+	defer server.Close()
+	cacheDir := t.TempDir()
+	fingerprint := sha256.Sum256(testIssuer)
+	issuerPath := "/issuer/" + hex.EncodeToString(fingerprint[:])
+
+	for i := 0; i < 2; i++ {
+		// a new client does not have the issuer in memory
+		c := server.client(t, tree.publicKey, 300, cacheDir)
+		resp, err := c.GetRawEntries(context.Background(), 200, 299)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkEntries(t, tree, resp, 200, 299)
+	}
+	if server.count("/tile/data/000") != 1 || server.count(issuerPath) != 1 {
+		t.Fatalf("requests = %v, want full tiles and issuers to be fetched once", server.requests)
+	}
+	if server.count("/tile/data/001.p/44") != 2 {
+		t.Fatalf("requests = %v, want partial tiles not to be cached", server.requests)
+	}
+	_, err := os.Stat(filepath.Join(cacheDir, filepath.FromSlash(testOrigin), "tile", "data", "000"))
+	if err != nil {
+		t.Fatalf("full tile is not in the cache: %v", err)
+	}
+}
+
+func TestTileClientIssuerMismatch(t *testing.T) {
+	tree := newTestTree(t, 10, 10)
+	fingerprint := sha256.Sum256(testIssuer)
+	writeTestFile(t, tree.dir, "issuer/"+hex.EncodeToString(fingerprint[:]), []byte("another issuer"))
+	server := newTestTileServer(tree.dir)
+	defer server.Close()
+
+	_, err := server.client(t, tree.publicKey, 10, "").GetRawEntries(context.Background(), 0, 9)
+	if err == nil {
+		t.Fatal("got entries with an issuer that does not match its fingerprint")
+	}
+}
+
+func TestTileClientProofs(t *testing.T) {
+	tree := newTestTree(t, 300, 300)
+	server := newTestTileServer(tree.dir)
+	defer server.Close()
+	c := server.client(t, tree.publicKey, 300, "")
+	ctLog := &CTLog{TreeSize: 300, RootHash: tree.rootHash}
+
+	for _, index := range []int64{0, 255, 256, 299} {
+		err := VerifyInclusion(context.Background(), c, ctLog, index, tree.leafInputs[index])
+		if err != nil {
+			t.Errorf("inclusion of entry %d: %v", index, err)
+		}
+	}
+}
+
+func TestVerifyConsistencyOlderSTH(t *testing.T) {
+	tree := newTestTree(t, 300, 300)
+	server := newTestTileServer(tree.dir)
+	defer server.Close()
+	c := server.client(t, tree.publicKey, 300, "")
+	ctLog := &CTLog{TreeSize: 300, RootHash: tree.rootHash}
+
+	var leafHashes [][]byte
+	for _, leafInput := range tree.leafInputs[:200] {
+		leafHashes = append(leafHashes, rfc6962.DefaultHasher.HashLeaf(leafInput))
+	}
+	sth := &ct.SignedTreeHead{TreeSize: 200}
+	copy(sth.SHA256RootHash[:], rootHash(leafHashes))
+	err := VerifyConsistency(context.Background(), c, ctLog, sth)
+	if !errors.Is(err, ErrStaleSTH) {
+		t.Fatalf("got %v for a consistent older sth, want ErrStaleSTH", err)
+	}
+
+	sth.SHA256RootHash[0] ^= 1
+	err = VerifyConsistency(context.Background(), c, ctLog, sth)
+	if err == nil || errors.Is(err, ErrStaleSTH) || errors.Is(err, ErrProofUnavailable) {
+		t.Fatalf("got %v for an inconsistent older sth, want a verification error", err)
+	}
+}
@@ -0,0 +1,162 @@
+package scanct
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// NetworkConfig restricts the addresses that scanned hosts may resolve to. Private and reserved addresses are
+// blocked unless AllowPrivate is set. AllowCIDRs are exempt from that, while DenyCIDRs are always blocked.
+type NetworkConfig struct {
+	AllowPrivate bool     `json:"allow_private"`
+	AllowCIDRs   []string `json:"allow_cidrs"`
+	DenyCIDRs    []string `json:"deny_cidrs"`
+}
+
+// reservedPrefixes are the private, loopback, link-local, shared, documentation, multicast and otherwise reserved
+// ranges, including transition ranges that embed IPv4 addresses.
+var reservedPrefixes = mustParsePrefixes(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24",
+	"192.0.2.0/24", "192.88.99.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24",
+	"224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "64:ff9b:1::/48", "100::/64", "2001::/32", "2001:db8::/32", "2002::/16",
+	"fc00::/7", "fe80::/10", "fec0::/10", "ff00::/8",
+)
+
+func mustParsePrefixes(cidrs ...string) []netip.Prefix {
+	prefixes, err := parsePrefixes(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return prefixes
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			// single addresses are accepted as well
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return nil, errors.Wrapf(err, "invalid cidr %q", cidr)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddressGuard decides which addresses may be connected to.
+type AddressGuard struct {
+	allowPrivate bool
+	allow        []netip.Prefix
+	deny         []netip.Prefix
+}
+
+func NewAddressGuard(config *NetworkConfig) (*AddressGuard, error) {
+	allow, err := parsePrefixes(config.AllowCIDRs)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse allowed cidrs")
+	}
+	deny, err := parsePrefixes(config.DenyCIDRs)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse denied cidrs")
+	}
+	return &AddressGuard{allowPrivate: config.AllowPrivate, allow: allow, deny: deny}, nil
+}
+
+// Allowed reports whether addr may be connected to.
+func (g *AddressGuard) Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if containsAddr(g.deny, addr) {
+		return false
+	}
+	if g.allowPrivate || containsAddr(g.allow, addr) {
+		return true
+	}
+	return !containsAddr(reservedPrefixes, addr)
+}
+
+// BlockedError is returned when connecting to a blocked address.
+type BlockedError struct {
+	Address string
+	IP      netip.Addr
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("connection to %s (%s) is blocked", e.Address, e.IP)
+}
+
+// DialContext connects to address like net.Dialer.DialContext. The addresses are checked after name resolution,
+// right before each connection attempt, so a name cannot resolve to a different address once it was checked.
+func (g *AddressGuard) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, ipAddress string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(ipAddress)
+			if err != nil {
+				return errors.Wrap(err, "could not parse dialed address")
+			}
+			if !g.Allowed(addrPort.Addr()) {
+				log.Warn().Str("address", address).Str("ip", addrPort.Addr().String()).Msg("blocked connection")
+				return &BlockedError{Address: address, IP: addrPort.Addr()}
+			}
+			if !scope.AllowsAddr(addrPort.Addr()) {
+				log.Warn().Str("address", address).Str("ip", addrPort.Addr().String()).Msg("blocked connection to out-of-scope address")
+				return &BlockedError{Address: address, IP: addrPort.Addr()}
+			}
+			return nil
+		},
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+var guard = &AddressGuard{}
+
+// SetNetworkConfig configures the addresses that Transport may connect to. Without a call, private and reserved
+// addresses are blocked.
+func SetNetworkConfig(config *NetworkConfig) error {
+	g, err := NewAddressGuard(config)
+	if err != nil {
+		return err
+	}
+	guard = g
+	return nil
+}
+
+// Transport is shared by all connections to scanned hosts. It never uses a proxy, because the proxy would connect
+// to addresses that are not checked.
+var Transport = &http.Transport{
+	DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+		return guard.DialContext(ctx, network, address)
+	},
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// NewHTTPClient returns a client that connects through Transport.
+func NewHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: Transport}
+}
@@ -0,0 +1,74 @@
+package scanct
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/pkg/errors"
+	"github.com/transparency-dev/merkle/proof"
+	"github.com/transparency-dev/merkle/rfc6962"
+)
+
+// ErrProofUnavailable is returned if a proof could not be fetched from the log. Unlike a proof that does not
+// verify, it does not mean that the log misbehaved.
+var ErrProofUnavailable = errors.New("proof unavailable")
+
+// ErrStaleSTH is returned for an STH that is older than the one stored but consistent with it. Load-balanced logs
+// serve them whenever a request reaches a frontend that is behind, so they are skipped instead of failing
+// verification.
+var ErrStaleSTH = errors.New("stale sth")
+
+// VerifyConsistency checks that sth extends the last STH stored for ctLog. Logs without a stored STH are
+// trusted on first use.
+func VerifyConsistency(ctx context.Context, c LogClient, ctLog *CTLog, sth *ct.SignedTreeHead) error {
+	if ctLog.TreeSize == 0 {
+		return nil
+	}
+	if sth.TreeSize < ctLog.TreeSize {
+		err := verifyConsistencyProof(ctx, c, sth.TreeSize, ctLog.TreeSize, sth.SHA256RootHash[:], ctLog.RootHash)
+		if errors.Is(err, ErrProofUnavailable) {
+			return err
+		} else if err != nil {
+			return errors.Wrapf(err, "sth at tree size %d is inconsistent with larger tree size %d", sth.TreeSize, ctLog.TreeSize)
+		}
+		return fmt.Errorf("%w: tree size %d is older than %d", ErrStaleSTH, sth.TreeSize, ctLog.TreeSize)
+	}
+	if sth.TreeSize == ctLog.TreeSize {
+		if !bytes.Equal(sth.SHA256RootHash[:], ctLog.RootHash) {
+			return fmt.Errorf("root hash changed at tree size %d", sth.TreeSize)
+		}
+		return nil
+	}
+	err := verifyConsistencyProof(ctx, c, ctLog.TreeSize, sth.TreeSize, ctLog.RootHash, sth.SHA256RootHash[:])
+	if errors.Is(err, ErrProofUnavailable) {
+		return err
+	} else if err != nil {
+		return errors.Wrapf(err, "sth at tree size %d is inconsistent with tree size %d", sth.TreeSize, ctLog.TreeSize)
+	}
+	return nil
+}
+
+// verifyConsistencyProof fetches the consistency proof from the tree of size first to the one of size second and
+// checks it against their root hashes. The empty tree is consistent with every tree and needs no proof.
+func verifyConsistencyProof(ctx context.Context, c LogClient, first, second uint64, firstRoot, secondRoot []byte) error {
+	var consistency [][]byte
+	if first > 0 {
+		var err error
+		consistency, err = c.GetSTHConsistency(ctx, first, second)
+		if err != nil {
+			return fmt.Errorf("%w: could not get consistency proof: %v", ErrProofUnavailable, err)
+		}
+	}
+	return proof.VerifyConsistency(rfc6962.DefaultHasher, first, second, consistency, firstRoot, secondRoot)
+}
+
+// VerifyInclusion checks that the leaf at index is part of the tree described by the STH stored in ctLog.
+func VerifyInclusion(ctx context.Context, c LogClient, ctLog *CTLog, index int64, leafInput []byte) error {
+	leafHash := rfc6962.DefaultHasher.HashLeaf(leafInput)
+	auditPath, err := c.GetInclusionProof(ctx, index, leafHash, ctLog.TreeSize)
+	if err != nil {
+		return fmt.Errorf("%w: could not get inclusion proof: %v", ErrProofUnavailable, err)
+	}
+	return proof.VerifyInclusion(rfc6962.DefaultHasher, uint64(index), ctLog.TreeSize, leafHash, auditPath, ctLog.RootHash)
+}
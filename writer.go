@@ -0,0 +1,116 @@
+package scanct
+
+import (
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+// Write is a write to the database. The database passed to it is a transaction shared with other writes.
+type Write func(*Database) error
+
+type writeRequest struct {
+	write   Write
+	flushed chan struct{}
+}
+
+// Writer applies writes through a single connection. Writes are grouped into one transaction until size of them
+// are pending or interval has passed, so that a step with many workers does not commit every result on its own.
+type Writer struct {
+	db       Database
+	size     int
+	interval time.Duration
+	requests chan writeRequest
+}
+
+func NewWriter(size int, interval time.Duration) (*Writer, error) {
+	db, err := NewDatabase()
+	if err != nil {
+		return nil, err
+	}
+	if size < 1 {
+		size = 1
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	w := &Writer{db: db, size: size, interval: interval, requests: make(chan writeRequest, size)}
+	go w.run()
+	return w, nil
+}
+
+func (w *Writer) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	var pending []Write
+	for {
+		select {
+		case request := <-w.requests:
+			if request.write != nil {
+				pending = append(pending, request.write)
+			}
+			if len(pending) >= w.size || request.flushed != nil && len(pending) > 0 {
+				w.commit(pending)
+				pending = nil
+			}
+			if request.flushed != nil {
+				close(request.flushed)
+			}
+		case <-ticker.C:
+			if len(pending) > 0 {
+				w.commit(pending)
+				pending = nil
+			}
+		}
+	}
+}
+
+func (w *Writer) commit(writes []Write) {
+	start := time.Now()
+	err := w.db.db.Transaction(func(tx *gorm.DB) error {
+		db := Database{db: tx, filter: w.db.filter}
+		for _, write := range writes {
+			err := write(&db)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal().Err(err).Int("writes", len(writes)).Msg("could not commit writes")
+	}
+	log.Debug().Int("writes", len(writes)).Dur("duration", time.Since(start)).Msg("committed writes")
+}
+
+// Write queues write. It is committed with the next batch.
+func (w *Writer) Write(write Write) {
+	w.requests <- writeRequest{write: write}
+}
+
+// Flush returns once all writes queued before are committed.
+func (w *Writer) Flush() {
+	flushed := make(chan struct{})
+	w.requests <- writeRequest{flushed: flushed}
+	<-flushed
+}
+
+var (
+	writer     *Writer
+	writerOnce sync.Once
+)
+
+// SharedWriter returns the writer shared by all process steps. It is created on first use with the flush size and
+// interval of the database config. Certificates are stored through their own connections instead, because their
+// callers need the stored hosts once a batch is committed.
+func SharedWriter() *Writer {
+	writerOnce.Do(func() {
+		var err error
+		writer, err = NewWriter(databaseConfig.FlushSize, time.Duration(databaseConfig.FlushInterval))
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create writer")
+		}
+	})
+	return writer
+}